@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+// With ASYNC_WRITES=true, POST / doesn't write the car itself: it validates
+// it, assigns its id, queues it on WRITE_QUEUE_URL and answers 202 with the
+// id. A worker (a copy of this function with WRITE_WORKER=true, see
+// processWrites) consumes the queue and does the write, so bursts are
+// absorbed by the queue instead of by DynamoDB capacity.
+//
+// Each queued write has a record in WRITE_STATUS_TABLE_NAME, served by
+// GET /writes/{id}: pending until the worker has run, then done or failed
+// with the error code the synchronous POST would have returned. Records
+// expire after WRITE_STATUS_TTL_HOURS. A failed write can be resubmitted
+// with the same id; a pending or done one gets 409.
+//
+// Writes that fail for other reasons are left on the queue to be retried
+// and end up in its dead-letter queue, still pending. If the car is written
+// but its record can't be updated, the record also stays pending; the car
+// is readable under its id either way.
+const defaultWriteStatusTTL = 24 * time.Hour
+
+var sqsClient *sqs.Client
+
+func initAsyncWrites(cfg aws.Config) {
+	if os.Getenv("WRITE_QUEUE_URL") != "" {
+		sqsClient = sqs.NewFromConfig(cfg)
+	}
+}
+
+func asyncWritesEnabled() bool {
+	return os.Getenv("ASYNC_WRITES") == "true"
+}
+
+func writeWorkerMode() bool {
+	return os.Getenv("WRITE_WORKER") == "true"
+}
+
+type writeStatus struct {
+	ID     string    `json:"id"`
+	Status string    `json:"status"`
+	Error  *apiError `json:"error,omitempty"`
+}
+
+// enqueueCar queues a validated car that already has its id and answers 202.
+func (a *App) enqueueCar(ctx context.Context, item Car) (events.APIGatewayV2HTTPResponse, error) {
+	queue := os.Getenv("WRITE_QUEUE_URL")
+	table := os.Getenv("WRITE_STATUS_TABLE_NAME")
+	if queue == "" || table == "" || sqsClient == nil {
+		return handleInternalError(ctx, errors.New("WRITE_QUEUE_URL and WRITE_STATUS_TABLE_NAME must be set for async writes")), nil
+	}
+
+	_, err := a.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]types.AttributeValue{
+			"ID":        &types.AttributeValueMemberS{Value: item.ID},
+			"Status":    &types.AttributeValueMemberS{Value: "pending"},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(writeStatusTTL()).Unix(), 10)},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#id) OR #status = :failed"),
+		ExpressionAttributeNames: map[string]string{"#id": "ID", "#status": "Status"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":failed": &types.AttributeValueMemberS{Value: "failed"},
+		},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errorResponse(http.StatusConflict, "ALREADY_EXISTS", fmt.Sprintf("a write for car %s was already accepted", item.ID)), nil
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ := json.Marshal(item)
+	_, err = sqsClient.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:    &queue,
+		MessageBody: aws.String(string(body)),
+	})
+	if err != nil {
+		// Free the id again so the client can retry.
+		if _, derr := a.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: &table,
+			Key: map[string]types.AttributeValue{
+				"ID": &types.AttributeValueMemberS{Value: item.ID},
+			},
+		}); derr != nil {
+			loggerFrom(ctx).Warn("releasing write status failed", "id", item.ID, "error", derr)
+		}
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ = json.Marshal(writeStatus{ID: item.ID, Status: "pending"})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusAccepted,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Location":     "/writes/" + url.PathEscape(item.ID),
+		},
+	}, nil
+}
+
+// handleWriteStatus serves GET /writes/{id}.
+func (a *App) handleWriteStatus(ctx context.Context, id string) (events.APIGatewayV2HTTPResponse, error) {
+	table := os.Getenv("WRITE_STATUS_TABLE_NAME")
+	if table == "" {
+		return errorResponse(http.StatusNotFound, "NOT_FOUND", "async writes are not enabled"), nil
+	}
+	out, err := a.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	if out.Item == nil {
+		return errorResponse(http.StatusNotFound, "NOT_FOUND", "no queued write for this id"), nil
+	}
+
+	status := writeStatus{ID: id, Status: stringAttr(out.Item, "Status")}
+	if code := stringAttr(out.Item, "ErrorCode"); code != "" {
+		status.Error = &apiError{Code: code, Message: stringAttr(out.Item, "ErrorMessage")}
+	}
+	headers := map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"}
+	if status.Status == "done" {
+		headers["Location"] = "/cars/" + url.PathEscape(id)
+	}
+	body, _ := json.Marshal(status)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    headers,
+	}, nil
+}
+
+// processWrites is the worker's handler. Cars the synchronous POST would
+// have rejected are marked failed and dropped; other errors are reported
+// as batch item failures so only those messages are retried.
+func (a *App) processWrites(ctx context.Context, e events.SQSEvent) (events.SQSEventResponse, error) {
+	var resp events.SQSEventResponse
+	table := a.table
+	if table == "" {
+		return resp, errors.New("TABLE_NAME environment variable is not set")
+	}
+	for _, msg := range e.Records {
+		logger := loggerFrom(ctx).With("messageId", msg.MessageId)
+		var item Car
+		if err := json.Unmarshal([]byte(msg.Body), &item); err != nil || item.ID == "" {
+			logger.Error("dropping malformed write message", "error", err)
+			continue
+		}
+
+		err := a.createCar(ctx, table, &item)
+		var ccf *types.ConditionalCheckFailedException
+		switch {
+		case errors.As(err, &ccf):
+			a.markWrite(ctx, item.ID, "failed", &apiError{Code: "ALREADY_EXISTS", Message: fmt.Sprintf("car with id %s already exists", item.ID)})
+		case errors.Is(err, errMakeModelTaken):
+			a.markWrite(ctx, item.ID, "failed", &apiError{Code: "DUPLICATE_MAKE_MODEL", Message: errMakeModelTaken.Error()})
+		case err != nil:
+			logger.Error("queued write failed", "id", item.ID, "error", err)
+			resp.BatchItemFailures = append(resp.BatchItemFailures, events.SQSBatchItemFailure{ItemIdentifier: msg.MessageId})
+		default:
+			a.markWrite(ctx, item.ID, "done", nil)
+		}
+	}
+	return resp, nil
+}
+
+// markWrite records the outcome of a queued write. It is best effort: a
+// failure is only logged, since retrying the write itself would then fail
+// with ALREADY_EXISTS.
+func (a *App) markWrite(ctx context.Context, id, status string, apiErr *apiError) {
+	table := os.Getenv("WRITE_STATUS_TABLE_NAME")
+	if table == "" {
+		return
+	}
+	expr := "SET #status = :status REMOVE #code, #message"
+	names := map[string]string{"#status": "Status", "#code": "ErrorCode", "#message": "ErrorMessage"}
+	values := map[string]types.AttributeValue{
+		":status": &types.AttributeValueMemberS{Value: status},
+	}
+	if apiErr != nil {
+		expr = "SET #status = :status, #code = :code, #message = :message"
+		values[":code"] = &types.AttributeValueMemberS{Value: apiErr.Code}
+		values[":message"] = &types.AttributeValueMemberS{Value: apiErr.Message}
+	}
+	_, err := a.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:          aws.String(expr),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("updating write status failed", "id", id, "status", status, "error", err)
+	}
+}
+
+// writeStatusTTL reads WRITE_STATUS_TTL_HOURS, falling back to
+// defaultWriteStatusTTL when it is unset or invalid.
+func writeStatusTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("WRITE_STATUS_TTL_HOURS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Hour
+	}
+	return defaultWriteStatusTTL
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// When the function is exposed through a Lambda function URL with
+// AuthorizationType NONE, anyone who finds the URL can call it. The
+// deployment mirrors the URL's auth type into FUNCTION_URL_AUTH_TYPE so the
+// function knows; in that mode writes are refused unless
+// ALLOW_UNAUTHENTICATED_WRITES=true opts back in. Reads stay open.
+var writesBlocked bool
+
+func initAuthGuard() {
+	if !strings.EqualFold(os.Getenv("FUNCTION_URL_AUTH_TYPE"), "NONE") {
+		return
+	}
+	if os.Getenv("ALLOW_UNAUTHENTICATED_WRITES") == "true" {
+		slog.Warn("function URL has AuthorizationType NONE and ALLOW_UNAUTHENTICATED_WRITES=true; anyone with the URL can modify data")
+		return
+	}
+	writesBlocked = true
+	slog.Warn("function URL has AuthorizationType NONE; refusing POST, PUT, PATCH and DELETE. Set ALLOW_UNAUTHENTICATED_WRITES=true to allow them")
+}
+
+// isWriteMethod reports whether method can modify data.
+func isWriteMethod(method string) bool {
+	switch method {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
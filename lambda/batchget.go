@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// DynamoDB caps BatchGetItem at 100 keys per call.
+const batchGetLimit = 100
+
+// defaultMaxBatchGetIDs bounds how many ids one request may ask for when
+// MAX_BATCH_GET_IDS is not set.
+const defaultMaxBatchGetIDs = 200
+
+// batchGetResult is the response for GET /?ids=a,b,c. Items follow the order
+// of the requested ids; ids that don't exist are left out of Items and listed
+// in NotFound instead.
+type batchGetResult struct {
+	Items    []Car    `json:"items"`
+	NotFound []string `json:"notFound"`
+}
+
+func (a *App) handleBatchGet(ctx context.Context, table string, rawIDs string, includeDeleted bool) (events.APIGatewayV2HTTPResponse, error) {
+	ids := parseIDList(rawIDs)
+	if len(ids) == 0 {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", "ids query parameter must list at least one id"), nil
+	}
+
+	if limit := maxBatchGetIDs(); len(ids) > limit {
+		return errorResponse(http.StatusRequestEntityTooLarge, "TOO_MANY_IDS", fmt.Sprintf("too many ids: %d requested, at most %d allowed", len(ids), limit)), nil
+	}
+
+	found, err := a.batchGetCars(ctx, table, ids)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	result := batchGetResult{Items: []Car{}, NotFound: []string{}}
+	for _, id := range ids {
+		if car, ok := found[id]; ok && (!car.Deleted || includeDeleted) {
+			result.Items = append(result.Items, car)
+		} else {
+			result.NotFound = append(result.NotFound, id)
+		}
+	}
+
+	body, _ := json.Marshal(result)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// maxBatchGetIDs reads MAX_BATCH_GET_IDS, falling back to
+// defaultMaxBatchGetIDs when it is unset or invalid.
+func maxBatchGetIDs() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_BATCH_GET_IDS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxBatchGetIDs
+}
+
+// parseIDList splits a comma-separated id list, dropping blanks and
+// duplicates while keeping the first-seen order.
+func parseIDList(raw string) []string {
+	seen := map[string]bool{}
+	var ids []string
+	for _, id := range strings.Split(raw, ",") {
+		id = strings.TrimSpace(id)
+		if id == "" || seen[id] {
+			continue
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// batchGetCars fetches ids in chunks of batchGetLimit, retrying any
+// UnprocessedKeys, and returns the cars that exist keyed by id.
+func (a *App) batchGetCars(ctx context.Context, table string, ids []string) (map[string]Car, error) {
+	found := make(map[string]Car, len(ids))
+	for start := 0; start < len(ids); start += batchGetLimit {
+		end := min(start+batchGetLimit, len(ids))
+		keys := make([]map[string]types.AttributeValue, 0, end-start)
+		for _, id := range ids[start:end] {
+			keys = append(keys, map[string]types.AttributeValue{
+				"ID": &types.AttributeValueMemberS{Value: id},
+			})
+		}
+
+		pending := map[string]types.KeysAndAttributes{table: {Keys: keys}}
+		err := retryWithBackoff(ctx, func() (bool, error) {
+			out, err := a.db.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return false, err
+			}
+			// Drafts aren't cars yet, so they are reported as not found.
+			items := slices.DeleteFunc(out.Responses[table], isDraft)
+			for _, car := range decodeCars(items) {
+				found[car.ID] = car
+			}
+			pending = out.UnprocessedKeys
+			return len(pending) == 0, nil
+		})
+		if errors.Is(err, errRetriesExhausted) {
+			return nil, fmt.Errorf("%d keys still unprocessed after retries", len(pending[table].Keys))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return found, nil
+}
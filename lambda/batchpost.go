@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/google/uuid"
+)
+
+// defaultMaxBatchItems bounds how many cars one POST /batch may carry when
+// MAX_BATCH_ITEMS is not set.
+const defaultMaxBatchItems = 1000
+
+// batchFailure describes one car from a POST /batch body that wasn't
+// written. Index is its position in the request array.
+type batchFailure struct {
+	Index int    `json:"index"`
+	ID    string `json:"id,omitempty"`
+	// Code is set for failures a client may want to act on, e.g.
+	// ALREADY_EXISTS.
+	Code   string `json:"code,omitempty"`
+	Reason string `json:"reason"`
+}
+
+type batchSummary struct {
+	Written int            `json:"written"`
+	Failed  []batchFailure `json:"failed"`
+	// Deduplicated lists ids that appeared more than once in lenient mode;
+	// only their last occurrence was written.
+	Deduplicated []string `json:"deduplicated,omitempty"`
+	// DeadLettered counts the failed rows copied to DeadLetterKey in the
+	// export bucket when BATCH_DEAD_LETTER=true.
+	DeadLettered  int    `json:"deadLettered,omitempty"`
+	DeadLetterKey string `json:"deadLetterKey,omitempty"`
+}
+
+// deadLetterRow is one line of a dead-letter object: the row exactly as the
+// client sent it and why it wasn't written.
+type deadLetterRow struct {
+	Index  int             `json:"index"`
+	Row    json.RawMessage `json:"row"`
+	Reason string          `json:"reason"`
+}
+
+// handleBatchPost creates the cars in a JSON array body with BatchWriteItem.
+// Each car is validated on its own; invalid ones are reported in failed and
+// the rest are still written. The answer is 201 only when every car was
+// written and 207 Multi-Status otherwise, so a partial import is never
+// mistaken for a complete one.
+//
+// As on POST /, an existing car is never replaced: BatchWriteItem can't carry
+// a condition, so the ids are looked up first and those already taken, by a
+// car, a soft-deleted car or a draft, are reported in failed with
+// ALREADY_EXISTS. A car created between the lookup and the write can still
+// be overwritten. An id repeated within the batch fails the whole request
+// with 400 unless BATCH_DUPLICATE_IDS=lenient.
+func (a *App) handleBatchPost(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal([]byte(req.Body), &raw); err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "request body must be a JSON array of cars"), nil
+	}
+	if len(raw) == 0 {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "request body must list at least one car"), nil
+	}
+	if limit := maxBatchItems(); len(raw) > limit {
+		return errorResponse(http.StatusRequestEntityTooLarge, "TOO_MANY_ITEMS", fmt.Sprintf("too many cars: %d sent, at most %d allowed", len(raw), limit)), nil
+	}
+
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	summary := batchSummary{Failed: []batchFailure{}}
+	var puts []batchPut
+	for i, msg := range raw {
+		var item Car
+		if err := json.Unmarshal(msg, &item); errors.Is(err, errYearNotWhole) {
+			summary.Failed = append(summary.Failed, batchFailure{Index: i, Reason: err.Error()})
+			continue
+		} else if err != nil {
+			summary.Failed = append(summary.Failed, batchFailure{Index: i, Reason: "invalid car"})
+			continue
+		}
+		if err := item.Validate(); err != nil {
+			summary.Failed = append(summary.Failed, batchFailure{Index: i, ID: item.ID, Reason: err.Error()})
+			continue
+		}
+		if item.ID == "" {
+			item.ID = newCarID()
+		}
+		if len(item.ID) > maxIDLength {
+			summary.Failed = append(summary.Failed, batchFailure{Index: i, Reason: fmt.Sprintf("id must be at most %d characters", maxIDLength)})
+			continue
+		}
+		puts = append(puts, batchPut{index: i, id: item.ID, car: item})
+	}
+
+	// BatchWriteItem rejects a request that names the same key twice.
+	puts, dups := dedupeBatchPuts(puts)
+	if len(dups) > 0 {
+		if !lenientBatchDuplicates() {
+			return errorResponse(http.StatusBadRequest, "DUPLICATE_IDS", "duplicate ids in batch: "+strings.Join(dups, ", ")), nil
+		}
+		summary.Deduplicated = dups
+	}
+
+	if len(puts) > 0 {
+		ids := make([]string, len(puts))
+		for i, p := range puts {
+			ids[i] = p.id
+		}
+		existing, err := a.existingIDs(ctx, TableNameEnv, ids)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		puts = slices.DeleteFunc(puts, func(p batchPut) bool {
+			if !existing[p.id] {
+				return false
+			}
+			summary.Failed = append(summary.Failed, batchFailure{Index: p.index, ID: p.id, Code: "ALREADY_EXISTS", Reason: fmt.Sprintf("car with id %s already exists", p.id)})
+			return true
+		})
+	}
+
+	// One counter update for the whole batch, only for the rows that survived
+	// validation and deduplication.
+	if len(puts) > 0 {
+		last, err := a.reserveChangeSeqs(ctx, len(puts))
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		first := last - int64(len(puts)) + 1
+		now := nowTimestamp()
+		for i := range puts {
+			item := &puts[i].car
+			item.ChangeSeq = first + int64(i)
+			item.ChangeFeed = changeFeedName
+			item.CreatedAt = now
+			item.UpdatedAt = now
+			item.Version = 1
+			item.Deleted, item.DeletedAt = false, ""
+			av, err := attributevalue.MarshalMap(item)
+			if err != nil {
+				return handleInternalError(ctx, err), nil
+			}
+			puts[i].item = av
+		}
+	}
+
+	if uniqueMakeModelEnabled() {
+		puts = a.claimBatchMakeModels(ctx, puts, &summary)
+	}
+
+	for start := 0; start < len(puts); start += batchWriteLimit {
+		chunk := puts[start:min(start+batchWriteLimit, len(puts))]
+		// Only the rows still unprocessed failed; the others were written by
+		// earlier calls, even when a later one returned an error.
+		unprocessed, err := a.batchPutChunk(ctx, TableNameEnv, chunk)
+		reason := "not processed after retries"
+		if err != nil {
+			loggerFrom(ctx).Error("batch write failed", "cars", len(unprocessed), "error", err)
+			reason = "write failed"
+		}
+		for _, p := range chunk {
+			if unprocessed[p.id] {
+				summary.Failed = append(summary.Failed, batchFailure{Index: p.index, ID: p.id, Reason: reason})
+				a.releaseMakeModels(ctx, p.item)
+				continue
+			}
+			summary.Written++
+			invalidateCachedItems(p.id)
+			mirrorPut(p.item)
+		}
+	}
+
+	// Failed rows don't hold up the rest of the batch; with dead-lettering
+	// on they are also kept so they can be inspected and replayed.
+	if len(summary.Failed) > 0 && os.Getenv("BATCH_DEAD_LETTER") == "true" {
+		key, err := writeDeadLetters(ctx, raw, summary.Failed)
+		if err != nil {
+			loggerFrom(ctx).Error("dead-letter write failed", "rows", len(summary.Failed), "error", err)
+		} else {
+			summary.DeadLettered = len(summary.Failed)
+			summary.DeadLetterKey = key
+		}
+	}
+
+	status := http.StatusCreated
+	if len(summary.Failed) > 0 {
+		status = http.StatusMultiStatus
+	}
+	body, _ := json.Marshal(summary)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// claimBatchMakeModels claims the make and model of each put, dropping the
+// puts whose pair is taken (including by an earlier row of the same batch)
+// into summary.Failed.
+func (a *App) claimBatchMakeModels(ctx context.Context, puts []batchPut, summary *batchSummary) []batchPut {
+	kept := puts[:0]
+	for _, p := range puts {
+		err := a.claimMakeModel(ctx, p.car.Make, p.car.Model, p.id)
+		switch {
+		case errors.Is(err, errMakeModelTaken):
+			summary.Failed = append(summary.Failed, batchFailure{Index: p.index, ID: p.id, Reason: err.Error()})
+		case err != nil:
+			loggerFrom(ctx).Error("claiming make and model failed", "id", p.id, "error", err)
+			summary.Failed = append(summary.Failed, batchFailure{Index: p.index, ID: p.id, Reason: "write failed"})
+		default:
+			kept = append(kept, p)
+		}
+	}
+	return kept
+}
+
+// writeDeadLetters stores the failed rows as JSON lines under dead-letter/
+// in EXPORT_BUCKET and returns the object key.
+func writeDeadLetters(ctx context.Context, raw []json.RawMessage, failed []batchFailure) (string, error) {
+	bucket := os.Getenv("EXPORT_BUCKET")
+	if bucket == "" {
+		return "", errors.New("EXPORT_BUCKET environment variable is not set")
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, f := range failed {
+		if err := enc.Encode(deadLetterRow{Index: f.Index, Row: raw[f.Index], Reason: f.Reason}); err != nil {
+			return "", err
+		}
+	}
+	key := fmt.Sprintf("dead-letter/%s-%s.jsonl", time.Now().UTC().Format("20060102T150405Z"), uuid.NewString()[:8])
+	return key, putObject(ctx, bucket, key, "application/x-ndjson", buf.Bytes())
+}
+
+// maxBatchItems reads MAX_BATCH_ITEMS, falling back to defaultMaxBatchItems
+// when it is unset or invalid.
+func maxBatchItems() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_BATCH_ITEMS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxBatchItems
+}
+
+// lenientBatchDuplicates reports whether BATCH_DUPLICATE_IDS=lenient, which
+// keeps the last occurrence of a repeated id instead of rejecting the batch.
+func lenientBatchDuplicates() bool {
+	return os.Getenv("BATCH_DUPLICATE_IDS") == "lenient"
+}
+
+// dedupeBatchPuts keeps the last put for each id, preserving the order of
+// the survivors, and returns the ids that were repeated in first-seen order.
+func dedupeBatchPuts(puts []batchPut) ([]batchPut, []string) {
+	last := make(map[string]int, len(puts))
+	var dups []string
+	for i, p := range puts {
+		if _, seen := last[p.id]; seen && !slices.Contains(dups, p.id) {
+			dups = append(dups, p.id)
+		}
+		last[p.id] = i
+	}
+	if len(dups) == 0 {
+		return puts, nil
+	}
+	kept := make([]batchPut, 0, len(last))
+	for i, p := range puts {
+		if last[p.id] == i {
+			kept = append(kept, p)
+		}
+	}
+	return kept, dups
+}
+
+// existingIDs looks ids up with BatchGetItem, reading only the key, and
+// returns those that exist in any form: cars, soft-deleted cars and drafts.
+func (a *App) existingIDs(ctx context.Context, table string, ids []string) (map[string]bool, error) {
+	existing := map[string]bool{}
+	for start := 0; start < len(ids); start += batchGetLimit {
+		keys := make([]map[string]types.AttributeValue, 0, batchGetLimit)
+		for _, id := range ids[start:min(start+batchGetLimit, len(ids))] {
+			keys = append(keys, map[string]types.AttributeValue{
+				"ID": &types.AttributeValueMemberS{Value: id},
+			})
+		}
+
+		pending := map[string]types.KeysAndAttributes{table: {
+			Keys:                     keys,
+			ProjectionExpression:     aws.String("#id"),
+			ExpressionAttributeNames: map[string]string{"#id": "ID"},
+			ConsistentRead:           aws.Bool(true),
+		}}
+		err := retryWithBackoff(ctx, func() (bool, error) {
+			out, err := a.db.BatchGetItem(ctx, &dynamodb.BatchGetItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return false, err
+			}
+			for _, item := range out.Responses[table] {
+				existing[stringAttr(item, "ID")] = true
+			}
+			pending = out.UnprocessedKeys
+			return len(pending) == 0, nil
+		})
+		if errors.Is(err, errRetriesExhausted) {
+			return nil, fmt.Errorf("%d keys still unprocessed after retries", len(pending[table].Keys))
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return existing, nil
+}
+
+type batchPut struct {
+	index int
+	id    string
+	car   Car
+	item  map[string]types.AttributeValue
+}
+
+// batchPutChunk writes up to batchWriteLimit cars, retrying UnprocessedItems
+// with backoff, and returns the ids still unprocessed when it gives up. A
+// call failing part way through returns its error along with the ids not
+// written yet; the rest of the chunk went through on earlier calls.
+func (a *App) batchPutChunk(ctx context.Context, table string, chunk []batchPut) (map[string]bool, error) {
+	requests := make([]types.WriteRequest, 0, len(chunk))
+	for _, p := range chunk {
+		requests = append(requests, types.WriteRequest{
+			PutRequest: &types.PutRequest{Item: p.item},
+		})
+	}
+
+	pending := map[string][]types.WriteRequest{table: requests}
+	err := retryWithBackoff(ctx, func() (bool, error) {
+		out, err := a.db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+			RequestItems: pending,
+		})
+		if err != nil {
+			return false, err
+		}
+		pending = out.UnprocessedItems
+		return len(pending) == 0, nil
+	})
+	if errors.Is(err, errRetriesExhausted) {
+		err = nil
+	}
+
+	unprocessed := map[string]bool{}
+	for _, r := range pending[table] {
+		if id, ok := r.PutRequest.Item["ID"].(*types.AttributeValueMemberS); ok {
+			unprocessed[id.Value] = true
+		}
+	}
+	return unprocessed, err
+}
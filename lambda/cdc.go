@@ -0,0 +1,44 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// The stack attaches a third copy of this function to the cars table's
+// DynamoDB stream, with STREAM_PROCESSOR=true so main starts streamHandler.
+// The stream carries new and old images of every write, as the base for
+// syncing cars to search or analytics; for now the handler only logs the
+// keys that changed.
+func streamProcessorMode() bool {
+	return os.Getenv("STREAM_PROCESSOR") == "true"
+}
+
+// streamHandler logs one line per record. Returning an error would make
+// Lambda retry the whole batch, so records it can't make sense of are
+// logged and skipped.
+func streamHandler(ctx context.Context, e events.DynamoDBEvent) error {
+	for _, record := range e.Records {
+		logger := slog.Default().With("eventId", record.EventID)
+		id, ok := record.Change.Keys["ID"]
+		if !ok {
+			logger.Warn("stream record without ID key", "eventName", record.EventName)
+			continue
+		}
+		switch record.EventName {
+		case "INSERT":
+			logger.Info("car inserted", "id", id.String())
+		case "MODIFY":
+			logger.Info("car modified", "id", id.String())
+		case "REMOVE":
+			// TTL evictions of lapsed drafts come through as removals too.
+			logger.Info("car removed", "id", id.String(), "ttl", record.UserIdentity != nil)
+		default:
+			logger.Warn("unknown stream event", "eventName", record.EventName, "id", id.String())
+		}
+	}
+	return nil
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Every write stamps the car with the next value of a global change sequence
+// so clients can sync incrementally with GET /changes?since=N. ChangeIndex
+// is keyed on a constant ChangeFeed partition and ChangeSeq, which lets a
+// single Query return all changes after N in order.
+//
+// Deletes remove the item, so they are recorded separately as tombstones in
+// TOMBSTONES_TABLE_NAME, keyed on the same feed name and a sequence number
+// drawn from the same counter. /changes merges the two in sequence order.
+// Tombstones expire after TOMBSTONE_TTL_DAYS; a client that last synced
+// before that has to re-fetch everything.
+//
+// A sequence number is reserved before its write commits, and ChangeIndex is
+// eventually consistent, so a lower sequence can become visible after a
+// higher one. Gaps are also normal: an update moves a car to a new sequence
+// and a failed write never fills its slot. /changes therefore stops before a
+// gap while the change after it is younger than CHANGES_SETTLE_MS; once it is
+// older, the missing sequence is taken to be gone for good.
+const (
+	changeIndex      = "ChangeIndex"
+	changeFeedName   = "cars"
+	changeCounterKey = "changeSeq"
+
+	defaultTombstoneTTLDays = 30
+	defaultChangesSettle    = 5 * time.Second
+)
+
+type changesPage struct {
+	Items []Car `json:"items"`
+	// Deleted lists the cars deleted since the requested sequence.
+	Deleted []tombstone `json:"deleted"`
+	// HighWaterMark is the sequence of the last returned change, or the
+	// requested since when nothing changed. Pass it back as since to continue.
+	HighWaterMark int64 `json:"highWaterMark"`
+}
+
+type tombstone struct {
+	ID        string `json:"id" dynamodbav:"ID"`
+	ChangeSeq int64  `json:"changeSeq" dynamodbav:"Seq"`
+	DeletedAt string `json:"deletedAt" dynamodbav:"DeletedAt"`
+}
+
+// nextChangeSeq atomically increments the counter item in COUNTERS_TABLE_NAME
+// and returns the new value.
+func (a *App) nextChangeSeq(ctx context.Context) (int64, error) {
+	return a.reserveChangeSeqs(ctx, 1)
+}
+
+// reserveChangeSeqs atomically advances the counter by n and returns the
+// last reserved value; the block is last-n+1 through last.
+func (a *App) reserveChangeSeqs(ctx context.Context, n int) (int64, error) {
+	CountersTableEnv := os.Getenv("COUNTERS_TABLE_NAME")
+	if CountersTableEnv == "" {
+		return 0, errors.New("COUNTERS_TABLE_NAME environment variable is not set")
+	}
+	out, err := a.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &CountersTableEnv,
+		Key: map[string]types.AttributeValue{
+			"Name": &types.AttributeValueMemberS{Value: changeCounterKey},
+		},
+		UpdateExpression:         aws.String("ADD #v :n"),
+		ExpressionAttributeNames: map[string]string{"#v": "Value"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":n": &types.AttributeValueMemberN{Value: strconv.Itoa(n)},
+		},
+		ReturnValues: types.ReturnValueUpdatedNew,
+	})
+	if err != nil {
+		return 0, err
+	}
+	v, ok := out.Attributes["Value"].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("change counter has no numeric value")
+	}
+	return strconv.ParseInt(v.Value, 10, 64)
+}
+
+func (a *App) handleChanges(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	var since int64
+	if raw := req.QueryStringParameters["since"]; raw != "" {
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || n < 0 {
+			return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", "since must be a non-negative integer"), nil
+		}
+		since = n
+	}
+	limit, err := parseLimit(req.QueryStringParameters["limit"])
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+	}
+
+	out, err := a.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              &TableNameEnv,
+		IndexName:              aws.String(changeIndex),
+		KeyConditionExpression: aws.String("#feed = :feed AND #seq > :since"),
+		ExpressionAttributeNames: map[string]string{
+			"#feed": "ChangeFeed",
+			"#seq":  "ChangeSeq",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":feed":  &types.AttributeValueMemberS{Value: changeFeedName},
+			":since": &types.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            &limit,
+	})
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	tombstones, err := a.queryTombstones(ctx, since, limit)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	// Both sources are sorted by sequence and capped at limit, so the first
+	// limit changes of their union are all present; merge and cut there.
+	// The mark is read from the raw items so a skipped malformed item at the
+	// end isn't fetched again on the next call.
+	// A change that doesn't directly follow the previous one is held back,
+	// along with everything after it, until it has settled.
+	page := changesPage{Items: []Car{}, Deleted: []tombstone{}, HighWaterMark: since}
+	items, cars := out.Items, decodeCars(out.Items)
+	settledBefore := time.Now().Add(-envMillis("CHANGES_SETTLE_MS", defaultChangesSettle))
+	for taken := 0; taken < int(limit) && (len(items) > 0 || len(tombstones) > 0); taken++ {
+		itemSeq := int64(-1)
+		if len(items) > 0 {
+			if seq, ok := items[0]["ChangeSeq"].(*types.AttributeValueMemberN); ok {
+				itemSeq, _ = strconv.ParseInt(seq.Value, 10, 64)
+			}
+		}
+		if len(tombstones) > 0 && (len(items) == 0 || tombstones[0].ChangeSeq < itemSeq) {
+			if tombstones[0].ChangeSeq != page.HighWaterMark+1 && !settled(tombstones[0].DeletedAt, settledBefore) {
+				break
+			}
+			page.Deleted = append(page.Deleted, tombstones[0])
+			page.HighWaterMark = tombstones[0].ChangeSeq
+			tombstones = tombstones[1:]
+			continue
+		}
+		if itemSeq != page.HighWaterMark+1 && !settled(stringAttr(items[0], "UpdatedAt"), settledBefore) {
+			break
+		}
+		if len(cars) > 0 && cars[0].ChangeSeq == itemSeq {
+			page.Items = append(page.Items, cars[0])
+			cars = cars[1:]
+		}
+		page.HighWaterMark = itemSeq
+		items = items[1:]
+	}
+
+	body, _ := json.Marshal(page)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// settled reports whether a change stamped at the RFC 3339 time ts was made
+// before cutoff. The stamps have second precision, so they are rounded up to
+// the next second. A missing or unparseable stamp counts as settled so a bad
+// item can't stall the feed.
+func settled(ts string, cutoff time.Time) bool {
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		return true
+	}
+	return t.Add(time.Second).Before(cutoff)
+}
+
+// queryTombstones returns up to limit tombstones after since, oldest first.
+// Without TOMBSTONES_TABLE_NAME there are none.
+func (a *App) queryTombstones(ctx context.Context, since int64, limit int32) ([]tombstone, error) {
+	table := os.Getenv("TOMBSTONES_TABLE_NAME")
+	if table == "" {
+		return nil, nil
+	}
+	out, err := a.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:              &table,
+		KeyConditionExpression: aws.String("#feed = :feed AND #seq > :since"),
+		ExpressionAttributeNames: map[string]string{
+			"#feed": "Feed",
+			"#seq":  "Seq",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":feed":  &types.AttributeValueMemberS{Value: changeFeedName},
+			":since": &types.AttributeValueMemberN{Value: strconv.FormatInt(since, 10)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Limit:            &limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	var tombstones []tombstone
+	if err := attributevalue.UnmarshalListOfMaps(out.Items, &tombstones); err != nil {
+		return nil, err
+	}
+	return tombstones, nil
+}
+
+// recordTombstones adds a tombstone for each deleted id so /changes can
+// report the deletes. The cars are already gone by the time this runs, so a
+// failure is logged rather than failing the request.
+func (a *App) recordTombstones(ctx context.Context, ids ...string) {
+	table := os.Getenv("TOMBSTONES_TABLE_NAME")
+	if table == "" || len(ids) == 0 {
+		return
+	}
+	last, err := a.reserveChangeSeqs(ctx, len(ids))
+	if err != nil {
+		loggerFrom(ctx).Error("recording tombstones failed", "deleted", len(ids), "error", err)
+		return
+	}
+	now := time.Now().UTC()
+	expiresAt := now.AddDate(0, 0, tombstoneTTLDays()).Unix()
+	requests := make([]types.WriteRequest, 0, len(ids))
+	for i, id := range ids {
+		requests = append(requests, types.WriteRequest{PutRequest: &types.PutRequest{
+			Item: map[string]types.AttributeValue{
+				"Feed":      &types.AttributeValueMemberS{Value: changeFeedName},
+				"Seq":       &types.AttributeValueMemberN{Value: strconv.FormatInt(last-int64(len(ids)-1-i), 10)},
+				"ID":        &types.AttributeValueMemberS{Value: id},
+				"DeletedAt": &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+				"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt, 10)},
+			},
+		}})
+	}
+	for start := 0; start < len(requests); start += batchWriteLimit {
+		pending := map[string][]types.WriteRequest{table: requests[start:min(start+batchWriteLimit, len(requests))]}
+		err := retryWithBackoff(ctx, func() (bool, error) {
+			out, err := a.db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return false, err
+			}
+			pending = out.UnprocessedItems
+			return len(pending) == 0, nil
+		})
+		if err != nil {
+			loggerFrom(ctx).Error("recording tombstones failed", "deleted", len(ids), "error", err)
+			return
+		}
+	}
+}
+
+// tombstoneTTLDays reads TOMBSTONE_TTL_DAYS, falling back to
+// defaultTombstoneTTLDays when it is unset or invalid.
+func tombstoneTTLDays() int {
+	if n, err := strconv.Atoi(os.Getenv("TOMBSTONE_TTL_DAYS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultTombstoneTTLDays
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultGzipMinBytes is the smallest body compressed when GZIP_MIN_BYTES is
+// not set; below it gzip's overhead outweighs the savings.
+const defaultGzipMinBytes = 1024
+
+// compressResponse gzips the body when the client accepts gzip and the body
+// is at least GZIP_MIN_BYTES long. API Gateway only passes binary bodies
+// base64-encoded, so the result is sent with IsBase64Encoded. It runs last,
+// after signResponse, which therefore signs the uncompressed body.
+func compressResponse(resp events.APIGatewayV2HTTPResponse, acceptEncoding string) events.APIGatewayV2HTTPResponse {
+	if resp.IsBase64Encoded || len(resp.Body) < gzipMinBytes() {
+		return resp
+	}
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	// Whether the body is compressed depends on Accept-Encoding from here
+	// on, even when this request doesn't get it.
+	resp.Headers["Vary"] = addVary(resp.Headers["Vary"], "Accept-Encoding")
+	if !acceptsGzip(acceptEncoding) || resp.Headers["Content-Encoding"] != "" {
+		return resp
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte(resp.Body))
+	if err := zw.Close(); err != nil {
+		return resp
+	}
+	resp.Body = base64.StdEncoding.EncodeToString(buf.Bytes())
+	resp.IsBase64Encoded = true
+	resp.Headers["Content-Encoding"] = "gzip"
+	return resp
+}
+
+// acceptsGzip reports whether an Accept-Encoding header allows gzip, either
+// by name or through *, and doesn't rule it out with q=0.
+func acceptsGzip(header string) bool {
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+		q := strings.TrimSpace(params)
+		if v, ok := strings.CutPrefix(q, "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil && f == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// gzipMinBytes reads GZIP_MIN_BYTES, falling back to defaultGzipMinBytes
+// when it is unset or invalid.
+func gzipMinBytes() int {
+	if n, err := strconv.Atoi(os.Getenv("GZIP_MIN_BYTES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultGzipMinBytes
+}
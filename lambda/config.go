@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// initConfig loads the optional shared configuration named by
+// CONFIG_SSM_PATH: an SSM parameter holding a JSON object of environment
+// variable names to values, e.g. {"LOG_LEVEL": "debug", "DB_TIMEOUT_MS": 3000}.
+// Each entry is applied with os.Setenv, overriding the function's own
+// environment, so every setting read through os.Getenv can be managed
+// centrally for a fleet of functions.
+//
+// The parameter is read once per container; a change takes effect as
+// containers are recycled. A parameter that can't be read or parsed fails
+// the cold start rather than running with partial configuration.
+func initConfig(cfg aws.Config) {
+	path := os.Getenv("CONFIG_SSM_PATH")
+	if path == "" {
+		return
+	}
+	out, err := ssm.NewFromConfig(cfg).GetParameter(context.Background(), &ssm.GetParameterInput{
+		Name:           &path,
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		panic(fmt.Sprintf("unable to load config from SSM parameter %s, %v", path, err))
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(aws.ToString(out.Parameter.Value)), &values); err != nil {
+		panic(fmt.Sprintf("SSM parameter %s is not a JSON object, %v", path, err))
+	}
+	for name, raw := range values {
+		// Strings are used as is, anything else (numbers, booleans) as its
+		// JSON text.
+		var s string
+		if err := json.Unmarshal(raw, &s); err != nil {
+			s = string(raw)
+		}
+		os.Setenv(name, s)
+	}
+}
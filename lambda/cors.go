@@ -0,0 +1,75 @@
+package main
+
+import (
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// corsAllowedMethods must match the methods route handles.
+const corsAllowedMethods = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+
+// withCORS adds the Access-Control-Allow-* headers browsers need to call the
+// API from another origin, given the request's Origin header.
+//
+// With ALLOWED_ORIGINS, a comma-separated list, the request's origin is
+// echoed back only when it is on the list, and no CORS headers are sent
+// otherwise. The answer then depends on the origin, so Vary: Origin is set
+// either way to keep caches from serving one origin's response to another.
+// Without it the allowed origin comes from ALLOWED_ORIGIN and defaults to
+// "*".
+//
+// When the HTTP API has a CorsConfiguration, as the Pulumi stack sets up,
+// API Gateway answers preflights itself and replaces these headers with its
+// own; they still matter for the streaming function URL and direct invokes.
+func withCORS(resp events.APIGatewayV2HTTPResponse, origin string) events.APIGatewayV2HTTPResponse {
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	allowed := os.Getenv("ALLOWED_ORIGIN")
+	if list := os.Getenv("ALLOWED_ORIGINS"); list != "" {
+		resp.Headers["Vary"] = addVary(resp.Headers["Vary"], "Origin")
+		if !originAllowed(list, origin) {
+			return resp
+		}
+		allowed = origin
+	}
+	if allowed == "" {
+		allowed = "*"
+	}
+	resp.Headers["Access-Control-Allow-Origin"] = allowed
+	resp.Headers["Access-Control-Allow-Methods"] = corsAllowedMethods
+	resp.Headers["Access-Control-Allow-Headers"] = "Content-Type, Authorization, Range, Idempotency-Key, If-Match, If-None-Match"
+	resp.Headers["Access-Control-Expose-Headers"] = "Content-Range, Location, X-Route-Key, Idempotent-Replayed, ETag"
+	return resp
+}
+
+// originAllowed reports whether origin is one of the comma-separated list's
+// entries, or the list contains "*". An empty origin (not a browser request)
+// never matches.
+func originAllowed(list, origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range strings.Split(list, ",") {
+		if o = strings.TrimSpace(o); o == origin || o == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// addVary appends name to an existing Vary header value unless it is
+// already listed.
+func addVary(vary, name string) string {
+	if vary == "" {
+		return name
+	}
+	for _, v := range strings.Split(vary, ",") {
+		if strings.EqualFold(strings.TrimSpace(v), name) {
+			return vary
+		}
+	}
+	return vary + ", " + name
+}
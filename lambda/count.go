@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// handleCount serves GET /count, returning {"count": n} for the cars that
+// match the same make/model/minYear/maxYear filters as the list endpoint.
+// DynamoDB still reads every matching item (and with a filter, every
+// scanned one), but only the counts come back over the wire.
+func (a *App) handleCount(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	filter, err := buildListFilter(req.QueryStringParameters)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+	}
+	n, err := a.countItems(ctx, TableNameEnv, req.QueryStringParameters["make"], filter)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ := json.Marshal(map[string]int64{"count": n})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// countItems sums Count over every page of a Select COUNT scan, or of a
+// MakeIndex query when carMake is given, mirroring listItems.
+func (a *App) countItems(ctx context.Context, table, carMake string, f listFilter) (int64, error) {
+	var total int64
+	var startKey map[string]types.AttributeValue
+	if carMake == "" {
+		for {
+			out, err := a.db.Scan(ctx, &dynamodb.ScanInput{
+				TableName:                 &table,
+				Select:                    types.SelectCount,
+				ExclusiveStartKey:         startKey,
+				FilterExpression:          f.expression(),
+				ExpressionAttributeNames:  f.attributeNames(),
+				ExpressionAttributeValues: f.attributeValues(),
+			})
+			if err != nil {
+				return 0, err
+			}
+			total += int64(out.Count)
+			if len(out.LastEvaluatedKey) == 0 {
+				return total, nil
+			}
+			startKey = out.LastEvaluatedKey
+		}
+	}
+
+	f.names["#make"] = "Make"
+	f.values[":make"] = &types.AttributeValueMemberS{Value: carMake}
+	for {
+		out, err := a.db.Query(ctx, &dynamodb.QueryInput{
+			TableName:                 &table,
+			IndexName:                 aws.String(makeIndex),
+			Select:                    types.SelectCount,
+			KeyConditionExpression:    aws.String("#make = :make"),
+			FilterExpression:          f.expression(),
+			ExpressionAttributeNames:  f.names,
+			ExpressionAttributeValues: f.values,
+			ExclusiveStartKey:         startKey,
+		})
+		if err != nil {
+			return 0, err
+		}
+		total += int64(out.Count)
+		if len(out.LastEvaluatedKey) == 0 {
+			return total, nil
+		}
+		startKey = out.LastEvaluatedKey
+	}
+}
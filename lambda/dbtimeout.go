@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/smithy-go/middleware"
+)
+
+// defaultDBTimeout bounds a single DynamoDB operation, retries included,
+// when DB_TIMEOUT_MS is not set. Without it a hung call would hold the
+// invocation until Lambda kills it; dbErrorResponse turns the expired
+// deadline into a 504.
+const defaultDBTimeout = 5 * time.Second
+
+// withOperationTimeout is a DynamoDB client APIOptions entry that gives each
+// operation its own deadline. It runs first in the middleware stack, so the
+// deadline covers the SDK's retries too, and the cancel func runs as soon as
+// the operation returns.
+func withOperationTimeout(stack *middleware.Stack) error {
+	return stack.Initialize.Add(middleware.InitializeMiddlewareFunc("OperationTimeout",
+		func(ctx context.Context, in middleware.InitializeInput, next middleware.InitializeHandler) (middleware.InitializeOutput, middleware.Metadata, error) {
+			ctx, cancel := context.WithTimeout(ctx, dbTimeout())
+			defer cancel()
+			return next.HandleInitialize(ctx, in)
+		}), middleware.Before)
+}
+
+// dbTimeout reads DB_TIMEOUT_MS, falling back to defaultDBTimeout when it is
+// unset or invalid.
+func dbTimeout() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("DB_TIMEOUT_MS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return defaultDBTimeout
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// defaultDeadlineMargin is how long before the Lambda timeout withDeadline
+// gives up on a request when DEADLINE_MARGIN_MS is not set. It leaves time
+// to marshal and return the 504 before the platform kills the invocation.
+const defaultDeadlineMargin = 500 * time.Millisecond
+
+// withDeadline bounds next by the invocation's deadline minus the margin.
+// next gets a context with that deadline, so DynamoDB calls in flight are
+// cancelled and answered with a 504 by dbErrorResponse. A handler still
+// running when the budget is spent is abandoned and the client gets a 504
+// GATEWAY_TIMEOUT instead of API Gateway's bare 503 for a timed-out
+// invocation; what the abandoned handler returns later is dropped.
+//
+// next runs in its own goroutine, so withRecovery has to sit inside
+// withDeadline to catch its panics.
+func withDeadline(next func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)) func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+		deadline, ok := ctx.Deadline()
+		if !ok {
+			return next(ctx, req)
+		}
+		ctx, cancel := context.WithDeadline(ctx, deadline.Add(-deadlineMargin()))
+		defer cancel()
+
+		type result struct {
+			resp events.APIGatewayV2HTTPResponse
+			err  error
+		}
+		done := make(chan result, 1)
+		go func() {
+			resp, err := next(ctx, req)
+			done <- result{resp, err}
+		}()
+
+		select {
+		case r := <-done:
+			return r.resp, r.err
+		case <-ctx.Done():
+			id := req.RequestContext.RequestID
+			logger := slog.Default().With("requestId", id)
+			logger.Error("request exceeded its time budget",
+				"method", req.RequestContext.HTTP.Method,
+				"path", req.RequestContext.HTTP.Path,
+			)
+			resp := errorEnvelopeResponse(http.StatusGatewayTimeout, apiError{
+				Code:      "GATEWAY_TIMEOUT",
+				Message:   "the request did not complete in time",
+				RequestID: id,
+			})
+			return withCORS(resp, req.Headers["origin"]), nil
+		}
+	}
+}
+
+// deadlineMargin reads DEADLINE_MARGIN_MS, falling back to
+// defaultDeadlineMargin when it is unset or invalid.
+func deadlineMargin() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("DEADLINE_MARGIN_MS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return defaultDeadlineMargin
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Bulk deletes are two-phase: the first DELETE /?make=X only previews how
+// many cars would go and hands out a one-time confirmation token, the second
+// DELETE /?make=X&confirmToken=... actually removes them.
+const defaultConfirmTokenTTL = 5 * time.Minute
+
+// DynamoDB caps BatchWriteItem at 25 requests per call.
+const batchWriteLimit = 25
+
+type deletePreview struct {
+	Make         string `json:"make"`
+	Count        int    `json:"count"`
+	ConfirmToken string `json:"confirmToken"`
+	ExpiresAt    string `json:"expiresAt"`
+}
+
+// handleDelete removes a single car with DELETE /?id=X, or every car of a make
+// with the two-phase DELETE /?make=X flow.
+//
+// Single deletes answer 404 when the car doesn't exist. On success they answer
+// 204 with an empty body by default; deployments that set
+// DELETE_RETURNS_ITEM=true get 200 with the deleted car as JSON instead.
+func (a *App) handleDelete(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	if id := carID(req); id != "" {
+		return a.deleteByID(ctx, id)
+	}
+
+	carMake := req.QueryStringParameters["make"]
+	if carMake == "" {
+		return errorResponse(http.StatusBadRequest, "MISSING_PARAMETER", "id or make query parameter is required"), nil
+	}
+
+	TableNameEnv := a.table
+	ConfirmTableEnv := os.Getenv("CONFIRM_TABLE_NAME")
+	if TableNameEnv == "" || ConfirmTableEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME or CONFIRM_TABLE_NAME environment variable is not set")), nil
+	}
+
+	token := req.QueryStringParameters["confirmToken"]
+	if token == "" {
+		return a.previewDelete(ctx, TableNameEnv, ConfirmTableEnv, carMake)
+	}
+	return a.confirmDelete(ctx, TableNameEnv, ConfirmTableEnv, carMake, token)
+}
+
+func (a *App) deleteByID(ctx context.Context, id string) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	key := map[string]types.AttributeValue{
+		"ID": &types.AttributeValueMemberS{Value: id},
+	}
+	var deleted map[string]types.AttributeValue
+	if softDeleteEnabled() {
+		attrs, errResp := a.softDeleteByID(ctx, TableNameEnv, id)
+		if errResp != nil {
+			return *errResp, nil
+		}
+		deleted = attrs
+		mirrorPut(attrs)
+	} else {
+		out, err := a.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName:    &TableNameEnv,
+			Key:          key,
+			ReturnValues: types.ReturnValueAllOld,
+		})
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		if len(out.Attributes) == 0 {
+			return errorResponse(http.StatusNotFound, "NOT_FOUND", "item not found"), nil
+		}
+		deleted = out.Attributes
+		mirrorDelete(key)
+	}
+	invalidateCachedItems(id)
+	a.recordTombstones(ctx, id)
+	a.releaseMakeModels(ctx, deleted)
+
+	if os.Getenv("DELETE_RETURNS_ITEM") != "true" {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusNoContent,
+		}, nil
+	}
+
+	var item Car
+	if err := attributevalue.UnmarshalMap(deleted, &item); err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	body, _ := json.Marshal(item)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// previewDelete counts the cars that would be removed and stores a fresh
+// confirmation token. It always answers 409 so a client can't mistake the
+// preview for a completed delete.
+func (a *App) previewDelete(ctx context.Context, table, confirmTable, carMake string) (events.APIGatewayV2HTTPResponse, error) {
+	keys, err := a.queryKeysByMake(ctx, table, carMake)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	token, err := newConfirmToken()
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	expiresAt := time.Now().Add(confirmTokenTTL())
+
+	_, err = a.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &confirmTable,
+		Item: map[string]types.AttributeValue{
+			"Token":     &types.AttributeValueMemberS{Value: token},
+			"Make":      &types.AttributeValueMemberS{Value: carMake},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ := json.Marshal(deletePreview{
+		Make:         carMake,
+		Count:        len(keys),
+		ConfirmToken: token,
+		ExpiresAt:    expiresAt.UTC().Format(time.RFC3339),
+	})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusConflict,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+func (a *App) confirmDelete(ctx context.Context, table, confirmTable, carMake, token string) (events.APIGatewayV2HTTPResponse, error) {
+	// Consume the token first so that two concurrent confirmations can't
+	// both go through.
+	out, err := a.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &confirmTable,
+		Key: map[string]types.AttributeValue{
+			"Token": &types.AttributeValueMemberS{Value: token},
+		},
+		ConditionExpression: aws.String("attribute_exists(#t)"),
+		ExpressionAttributeNames: map[string]string{
+			"#t": "Token",
+		},
+		ReturnValues: types.ReturnValueAllOld,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errorResponse(http.StatusBadRequest, "INVALID_CONFIRM_TOKEN", "invalid or expired confirmation token"), nil
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	// TTL eviction is lazy, so the expiry has to be checked here as well.
+	tokenMake, _ := out.Attributes["Make"].(*types.AttributeValueMemberS)
+	expires, _ := out.Attributes["ExpiresAt"].(*types.AttributeValueMemberN)
+	if tokenMake == nil || tokenMake.Value != carMake || expires == nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_CONFIRM_TOKEN", "invalid or expired confirmation token"), nil
+	}
+	if exp, err := strconv.ParseInt(expires.Value, 10, 64); err != nil || time.Now().Unix() > exp {
+		return errorResponse(http.StatusBadRequest, "INVALID_CONFIRM_TOKEN", "invalid or expired confirmation token"), nil
+	}
+
+	keys, err := a.queryKeysByMake(ctx, table, carMake)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	if softDeleteEnabled() {
+		err = a.softDeleteKeys(ctx, table, keys)
+	} else {
+		err = a.batchDeleteKeys(ctx, table, keys)
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	invalidateCachedItems()
+	if !softDeleteEnabled() {
+		mirrorDelete(keys...)
+	}
+	ids := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if id, ok := key["ID"].(*types.AttributeValueMemberS); ok {
+			ids = append(ids, id.Value)
+		}
+	}
+	a.recordTombstones(ctx, ids...)
+	a.releaseMarkersOfMake(ctx, carMake, ids)
+
+	body, _ := json.Marshal(map[string]int{"deleted": len(keys)})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// queryKeysByMake returns the primary keys of every car with the given make
+// from MakeIndex, following LastEvaluatedKey across pages. Under
+// SOFT_DELETE cars already marked deleted are left out.
+func (a *App) queryKeysByMake(ctx context.Context, table, carMake string) ([]map[string]types.AttributeValue, error) {
+	names := map[string]string{
+		"#m":  "Make",
+		"#id": "ID",
+	}
+	var filter *string
+	if softDeleteEnabled() {
+		filter = aws.String("attribute_not_exists(#deleted)")
+		names["#deleted"] = "Deleted"
+	}
+	var keys []map[string]types.AttributeValue
+	input := &dynamodb.QueryInput{
+		TableName:                &table,
+		IndexName:                aws.String(makeIndex),
+		KeyConditionExpression:   aws.String("#m = :m"),
+		FilterExpression:         filter,
+		ProjectionExpression:     aws.String("#id"),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":m": &types.AttributeValueMemberS{Value: carMake},
+		},
+	}
+	for {
+		out, err := a.db.Query(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, out.Items...)
+		if len(out.LastEvaluatedKey) == 0 {
+			return keys, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// batchDeleteKeys removes keys in chunks of batchWriteLimit, retrying any
+// UnprocessedItems via retryWithBackoff.
+func (a *App) batchDeleteKeys(ctx context.Context, table string, keys []map[string]types.AttributeValue) error {
+	for start := 0; start < len(keys); start += batchWriteLimit {
+		end := min(start+batchWriteLimit, len(keys))
+		requests := make([]types.WriteRequest, 0, end-start)
+		for _, key := range keys[start:end] {
+			requests = append(requests, types.WriteRequest{
+				DeleteRequest: &types.DeleteRequest{Key: key},
+			})
+		}
+
+		pending := map[string][]types.WriteRequest{table: requests}
+		err := retryWithBackoff(ctx, func() (bool, error) {
+			out, err := a.db.BatchWriteItem(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: pending,
+			})
+			if err != nil {
+				return false, err
+			}
+			pending = out.UnprocessedItems
+			return len(pending) == 0, nil
+		})
+		if errors.Is(err, errRetriesExhausted) {
+			return fmt.Errorf("%d delete requests still unprocessed after retries", len(pending[table]))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func newConfirmToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// confirmTokenTTL reads CONFIRM_TOKEN_TTL_SECONDS, falling back to
+// defaultConfirmTokenTTL when it is unset or invalid.
+func confirmTokenTTL() time.Duration {
+	if s, err := strconv.Atoi(os.Getenv("CONFIRM_TOKEN_TTL_SECONDS")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultConfirmTokenTTL
+}
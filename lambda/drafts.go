@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// POST /cars/reserve hands out an id for a car whose details aren't known
+// yet, e.g. at the start of a multi-step form. It stores a placeholder with
+// Status=draft and an ExpiresAt that DynamoDB TTL evicts it at, after
+// DRAFT_TTL_MINUTES. A PATCH naming the draft's version promotes it to a
+// full car: it sets the fields like any update and removes Status and
+// ExpiresAt. Drafts are hidden from every read, and one past its expiry
+// can't be promoted even while TTL hasn't removed it yet.
+//
+// Drafts carry no ChangeFeed, so they stay out of the change feed until
+// promoted.
+const (
+	draftStatus          = "draft"
+	defaultDraftTTL      = time.Hour
+	draftStatusAttribute = "Status"
+	draftExpiryAttribute = "ExpiresAt"
+)
+
+type reservation struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	Version   int    `json:"version"`
+	ExpiresAt string `json:"expiresAt"`
+}
+
+func (a *App) handleReserve(ctx context.Context) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	id := newCarID()
+	now := time.Now().UTC()
+	expiresAt := now.Add(draftTTL())
+	_, err := a.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &TableNameEnv,
+		Item: map[string]types.AttributeValue{
+			"ID":                 &types.AttributeValueMemberS{Value: id},
+			draftStatusAttribute: &types.AttributeValueMemberS{Value: draftStatus},
+			draftExpiryAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+			"CreatedAt":          &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			"UpdatedAt":          &types.AttributeValueMemberS{Value: now.Format(time.RFC3339)},
+			"Version":            &types.AttributeValueMemberN{Value: "1"},
+		},
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]string{"#id": "ID"},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errorResponse(http.StatusConflict, "ALREADY_EXISTS", fmt.Sprintf("car with id %s already exists", id)), nil
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ := json.Marshal(reservation{
+		ID:        id,
+		Status:    draftStatus,
+		Version:   1,
+		ExpiresAt: expiresAt.Format(time.RFC3339),
+	})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Location":     "/cars/" + url.PathEscape(id),
+		},
+	}, nil
+}
+
+// isDraft reports whether a raw item is an unpromoted reservation.
+func isDraft(item map[string]types.AttributeValue) bool {
+	return stringAttr(item, draftStatusAttribute) == draftStatus
+}
+
+// isLapsedDraft reports whether a raw item is a reservation past its expiry.
+func isLapsedDraft(item map[string]types.AttributeValue) bool {
+	if !isDraft(item) {
+		return false
+	}
+	exp, err := strconv.ParseInt(numberAttr(item, draftExpiryAttribute), 10, 64)
+	return err != nil || time.Now().Unix() > exp
+}
+
+// draftTTL reads DRAFT_TTL_MINUTES, falling back to defaultDraftTTL when it
+// is unset or invalid.
+func draftTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("DRAFT_TTL_MINUTES")); err == nil && n > 0 {
+		return time.Duration(n) * time.Minute
+	}
+	return defaultDraftTTL
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// emfNamespace is the CloudWatch namespace the request metrics land in.
+const emfNamespace = "CarsApi"
+
+// emitRequestMetrics writes one CloudWatch Embedded Metric Format record
+// for a request: a Count of 1 and its Latency in milliseconds, both
+// dimensioned by method and status. CloudWatch Logs extracts the metrics
+// from the log line, so no agent or SDK call is needed.
+//
+// Unlike /metrics these are aggregated by CloudWatch across containers. The
+// record is formatted by hand to stay dependency-free; method is quoted
+// because it comes from the request.
+func emitRequestMetrics(method string, status int, elapsed time.Duration) {
+	fmt.Fprintf(os.Stdout,
+		`{"_aws":{"Timestamp":%d,"CloudWatchMetrics":[{"Namespace":%q,"Dimensions":[["Method","Status"]],"Metrics":[{"Name":"Count","Unit":"Count"},{"Name":"Latency","Unit":"Milliseconds"}]}]},"Method":%s,"Status":"%d","Count":1,"Latency":%s}`+"\n",
+		time.Now().UnixMilli(),
+		emfNamespace,
+		strconv.QuoteToASCII(method),
+		status,
+		strconv.FormatFloat(float64(elapsed.Microseconds())/1000, 'f', -1, 64),
+	)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// apiError is the body of every error response:
+//
+//	{"error": {"code": "NOT_FOUND", "message": "item not found"}}
+//
+// Code is a stable machine-readable identifier clients can switch on;
+// Message is for humans and may change. Fields is only set for validation
+// failures.
+type apiError struct {
+	Code    string       `json:"code"`
+	Message string       `json:"message"`
+	Fields  []fieldError `json:"fields,omitempty"`
+	// Allowed lists the accepted values when a value isn't one of them.
+	Allowed []string `json:"allowed,omitempty"`
+	// Dependency names the downstream service ("dynamodb", "s3") behind a
+	// DEPENDENCY_UNAVAILABLE error.
+	Dependency string `json:"dependency,omitempty"`
+	// RequestID is set on internal errors so callers can quote it when
+	// reporting the problem; it matches the line logged server-side.
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type errorEnvelope struct {
+	Error apiError `json:"error"`
+}
+
+// errorResponse builds the default error shape. Clients that ask for RFC 7807
+// get it converted by problemDetails on the way out.
+func errorResponse(status int, code, message string) events.APIGatewayV2HTTPResponse {
+	return errorEnvelopeResponse(status, apiError{Code: code, Message: message})
+}
+
+type requestIDKey struct{}
+
+// withRequestID stores the API Gateway request ID in ctx for
+// handleInternalError.
+func withRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// handleInternalError logs err in full and returns a generic 500 carrying
+// only the request ID, so SDK messages, table ARNs and the like never reach
+// the client.
+func handleInternalError(ctx context.Context, err error) events.APIGatewayV2HTTPResponse {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	loggerFrom(ctx).Error("internal error", "error", err)
+	return errorEnvelopeResponse(http.StatusInternalServerError, apiError{
+		Code:      "INTERNAL",
+		Message:   "internal server error",
+		RequestID: id,
+	})
+}
+
+func errorEnvelopeResponse(status int, e apiError) events.APIGatewayV2HTTPResponse {
+	body, _ := json.Marshal(errorEnvelope{Error: e})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}
+}
+
+// problem is an RFC 7807 Problem Details object.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	// Code, Errors, Allowed, Dependency and RequestID are extension
+	// members carrying the matching apiError fields.
+	Code       string       `json:"code,omitempty"`
+	Errors     []fieldError `json:"errors,omitempty"`
+	Allowed    []string     `json:"allowed,omitempty"`
+	Dependency string       `json:"dependency,omitempty"`
+	RequestID  string       `json:"requestId,omitempty"`
+}
+
+// wantsProblemDetails reports whether errors should be rendered as
+// application/problem+json, either for the whole deployment
+// (ERROR_FORMAT=problem) or because the client asked for it in Accept.
+func wantsProblemDetails(req events.APIGatewayV2HTTPRequest) bool {
+	if os.Getenv("ERROR_FORMAT") == "problem" {
+		return true
+	}
+	return strings.Contains(req.Headers["accept"], "application/problem+json")
+}
+
+// problemDetails rewrites an error built by errorResponse into RFC 7807 form.
+// Other responses, including 4xx ones carrying their own JSON body such as
+// the delete preview, are returned unchanged.
+func problemDetails(resp events.APIGatewayV2HTTPResponse, req events.APIGatewayV2HTTPRequest) events.APIGatewayV2HTTPResponse {
+	if resp.StatusCode < 400 {
+		return resp
+	}
+	var env errorEnvelope
+	if err := json.Unmarshal([]byte(resp.Body), &env); err != nil || env.Error.Code == "" {
+		return resp
+	}
+	instance := req.RawPath
+	if instance == "" {
+		instance = req.RequestContext.HTTP.Path
+	}
+	body, _ := json.Marshal(problem{
+		Type:       "about:blank",
+		Title:      http.StatusText(resp.StatusCode),
+		Status:     resp.StatusCode,
+		Detail:     env.Error.Message,
+		Instance:   instance,
+		Code:       env.Error.Code,
+		Errors:     env.Error.Fields,
+		Allowed:    env.Error.Allowed,
+		Dependency: env.Error.Dependency,
+		RequestID:  env.Error.RequestID,
+	})
+	resp.Body = string(body)
+	resp.Headers["Content-Type"] = "application/problem+json"
+	return resp
+}
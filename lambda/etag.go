@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// carETag formats the ETag for a version. A car's ETag is its Version in
+// quotes, e.g. "3", so it changes on every write. GET, POST, PUT and PATCH
+// return it, and PUT and PATCH have to send it back in If-Match.
+func carETag(version int) string {
+	return strconv.Quote(strconv.Itoa(version))
+}
+
+// itemETag returns the ETag of a raw item; cars without a Version are 0.
+func itemETag(item map[string]types.AttributeValue) string {
+	version, _ := strconv.Atoi(numberAttr(item, "Version"))
+	return carETag(version)
+}
+
+// etagVersion parses an If-Match value back into a version. Weak
+// validators are accepted since the ETag only stands for the version.
+// Anything else, including "*" and lists, reports false.
+func etagVersion(etag string) (int, bool) {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	unquoted, err := strconv.Unquote(etag)
+	if err != nil || !strings.HasPrefix(etag, `"`) {
+		return 0, false
+	}
+	version, err := strconv.Atoi(unquoted)
+	if err != nil || version < 0 {
+		return 0, false
+	}
+	return version, true
+}
+
+// ifMatchRequired reports whether PUT and PATCH must send If-Match: without
+// it the answer is 428, and 412 when the car has moved on.
+// REQUIRE_IF_MATCH=false relaxes this for older clients, which may then put
+// version in the body instead and get 409 on a stale one.
+func ifMatchRequired() bool {
+	return os.Getenv("REQUIRE_IF_MATCH") != "false"
+}
+
+// contentETag hashes a JSON body into an ETag for list pages, which have no
+// version of their own. The body is re-encoded canonically first, decoded
+// into generic values and marshalled again so object keys come out sorted,
+// which keeps the hash stable across field order, Lambda versions and Go
+// releases. Single cars keep their version ETag, which If-Match parses.
+func contentETag(body []byte) string {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err == nil {
+		if canonical, err := json.Marshal(v); err == nil {
+			body = canonical
+		}
+	}
+	sum := sha256.Sum256(body)
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match value names etag, either in
+// its list or through "*". The comparison is weak, as RFC 9110 asks for
+// If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/google/uuid"
+)
+
+// POST /export dumps the whole table to EXPORT_BUCKET as a set of part files
+// plus a manifest listing them, and returns a presigned URL for the manifest.
+// Each part holds up to EXPORT_PAGE_SIZE cars as JSON Lines.
+//
+// The export runs within the request, so a table too large to scan before
+// the Lambda timeout needs a bigger timeout or a smaller table. The list
+// filters apply as on GET /: drafts and soft-deleted cars are left out
+// unless an admin asks for includeDeleted=true (route checks the token),
+// since the manifest URL can be passed on to anyone.
+const (
+	defaultExportPageSize = 1000
+	manifestURLExpiry     = 15 * time.Minute
+)
+
+var s3Client *s3.Client
+
+type exportPart struct {
+	Key  string `json:"key"`
+	Rows int    `json:"rows"`
+}
+
+type exportManifest struct {
+	Bucket    string       `json:"bucket"`
+	CreatedAt string       `json:"createdAt"`
+	PageSize  int          `json:"pageSize"`
+	Rows      int          `json:"rows"`
+	Parts     []exportPart `json:"parts"`
+}
+
+func initExport(cfg aws.Config) {
+	s3Client = s3.NewFromConfig(cfg)
+}
+
+func (a *App) handleExport(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	BucketEnv := os.Getenv("EXPORT_BUCKET")
+	if TableNameEnv == "" || BucketEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME or EXPORT_BUCKET environment variable is not set")), nil
+	}
+
+	now := time.Now().UTC()
+	prefix := fmt.Sprintf("exports/%s-%s", now.Format("20060102T150405Z"), uuid.NewString()[:8])
+	manifest := exportManifest{
+		Bucket:    BucketEnv,
+		CreatedAt: now.Format(time.RFC3339),
+		PageSize:  exportPageSize(),
+		Parts:     []exportPart{},
+	}
+
+	var part bytes.Buffer
+	rows := 0
+	flush := func() error {
+		if rows == 0 {
+			return nil
+		}
+		key := fmt.Sprintf("%s/part-%05d.jsonl", prefix, len(manifest.Parts)+1)
+		if err := putObject(ctx, BucketEnv, key, "application/x-ndjson", part.Bytes()); err != nil {
+			return err
+		}
+		manifest.Parts = append(manifest.Parts, exportPart{Key: key, Rows: rows})
+		manifest.Rows += rows
+		part.Reset()
+		rows = 0
+		return nil
+	}
+
+	filter, err := buildListFilter(req.QueryStringParameters)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 &TableNameEnv,
+		FilterExpression:          filter.expression(),
+		ExpressionAttributeNames:  filter.attributeNames(),
+		ExpressionAttributeValues: filter.attributeValues(),
+	}
+	for {
+		out, err := a.db.Scan(ctx, input)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		for _, car := range decodeCars(out.Items) {
+			line, _ := json.Marshal(car)
+			part.Write(line)
+			part.WriteByte('\n')
+			rows++
+			if rows == manifest.PageSize {
+				if err := flush(); err != nil {
+					return dbErrorResponse(ctx, err), nil
+				}
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	if err := flush(); err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	manifestKey := prefix + "/manifest.json"
+	body, _ := json.Marshal(manifest)
+	if err := putObject(ctx, BucketEnv, manifestKey, "application/json", body); err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	presigned, err := s3.NewPresignClient(s3Client).PresignGetObject(ctx, &s3.GetObjectInput{
+		Bucket: &BucketEnv,
+		Key:    &manifestKey,
+	}, s3.WithPresignExpires(manifestURLExpiry))
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	body, _ = json.Marshal(map[string]interface{}{
+		"manifestKey": manifestKey,
+		"manifestUrl": presigned.URL,
+		"parts":       len(manifest.Parts),
+		"rows":        manifest.Rows,
+	})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusCreated,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+func putObject(ctx context.Context, bucket, key, contentType string, data []byte) error {
+	_, err := s3Client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket:      &bucket,
+		Key:         &key,
+		Body:        bytes.NewReader(data),
+		ContentType: &contentType,
+	})
+	return err
+}
+
+// exportPageSize reads EXPORT_PAGE_SIZE, falling back to
+// defaultExportPageSize when it is unset or invalid.
+func exportPageSize() int {
+	if n, err := strconv.Atoi(os.Getenv("EXPORT_PAGE_SIZE")); err == nil && n > 0 {
+		return n
+	}
+	return defaultExportPageSize
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// fieldAttributes maps the names accepted by ?fields= to the attributes
+// they select.
+var fieldAttributes = map[string]string{
+	"id":    "ID",
+	"make":  "Make",
+	"model": "Model",
+	"year":  "Year",
+	// Only present on soft-deleted cars, so it's omitted for the rest.
+	"deleted": "Deleted",
+}
+
+// parseFields validates a comma-separated ?fields= list. id is always
+// included so every returned object stays identifiable; an empty list
+// means "no projection" and is returned as nil.
+func parseFields(raw string) ([]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	fields := []string{"id"}
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" || name == "id" {
+			continue
+		}
+		if _, ok := fieldAttributes[name]; !ok {
+			return nil, fmt.Errorf("unknown field %q; allowed fields are id, make, model, year, deleted", name)
+		}
+		if !slices.Contains(fields, name) {
+			fields = append(fields, name)
+		}
+	}
+	return fields, nil
+}
+
+// project makes the list read return only the given fields.
+func (f *listFilter) project(fields []string) {
+	refs := make([]string, 0, len(fields))
+	for _, name := range fields {
+		placeholder := "#f_" + name
+		f.names[placeholder] = fieldAttributes[name]
+		refs = append(refs, placeholder)
+	}
+	f.projection = strings.Join(refs, ", ")
+}
+
+// sparseItems converts projected items into objects holding only the
+// requested fields, under their JSON names. Items that can't be decoded are
+// logged and skipped, as in decodeCars.
+func sparseItems(items []map[string]types.AttributeValue, fields []string) []map[string]any {
+	out := make([]map[string]any, 0, len(items))
+	for _, item := range items {
+		var attrs map[string]any
+		if err := attributevalue.UnmarshalMap(item, &attrs); err != nil {
+			slog.Warn("skipping malformed item", "error", err)
+			continue
+		}
+		obj := make(map[string]any, len(fields))
+		for _, name := range fields {
+			if v, ok := attrs[fieldAttributes[name]]; ok {
+				obj[name] = v
+			}
+		}
+		out = append(out, obj)
+	}
+	return out
+}
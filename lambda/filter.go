@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// listFilter is a DynamoDB filter expression built from list query parameters.
+// No conditions means "no filter". projection, set by project, limits the
+// attributes read.
+type listFilter struct {
+	conditions []string
+	names      map[string]string
+	values     map[string]types.AttributeValue
+	projection string
+}
+
+// buildListFilter combines the model, minYear and maxYear query parameters
+// with AND; absent parameters add no condition. make is handled separately
+// by listItems since it can be served from MakeIndex. model matches any car
+// whose model contains it, so ?model=Cor finds both Corolla and Corsa. All
+// string matching is case-sensitive. Drafts are always filtered out,
+// soft-deleted cars unless includeDeleted=true.
+//
+// TODO: case-insensitive make and model matching needs lowercased copies of
+// Make and Model stored on write, since DynamoDB filter expressions can't
+// fold case.
+func buildListFilter(params map[string]string) (listFilter, error) {
+	f := listFilter{
+		names:  map[string]string{},
+		values: map[string]types.AttributeValue{},
+	}
+	f.names["#status"] = draftStatusAttribute
+	f.conditions = append(f.conditions, "attribute_not_exists(#status)")
+	if params["includeDeleted"] != "true" {
+		f.names["#deleted"] = "Deleted"
+		f.conditions = append(f.conditions, "attribute_not_exists(#deleted)")
+	}
+	if v := params["model"]; v != "" {
+		f.names["#model"] = "Model"
+		f.values[":model"] = &types.AttributeValueMemberS{Value: v}
+		f.conditions = append(f.conditions, "contains(#model, :model)")
+	}
+	if v := params["minYear"]; v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			return listFilter{}, errors.New("minYear must be an integer")
+		}
+		f.names["#year"] = "Year"
+		f.values[":minYear"] = &types.AttributeValueMemberN{Value: strconv.Itoa(year)}
+		f.conditions = append(f.conditions, "#year >= :minYear")
+	}
+	if v := params["maxYear"]; v != "" {
+		year, err := strconv.Atoi(v)
+		if err != nil {
+			return listFilter{}, errors.New("maxYear must be an integer")
+		}
+		f.names["#year"] = "Year"
+		f.values[":maxYear"] = &types.AttributeValueMemberN{Value: strconv.Itoa(year)}
+		f.conditions = append(f.conditions, "#year <= :maxYear")
+	}
+	return f, nil
+}
+
+// expression joins the conditions, returning nil when there are none so the
+// result can be assigned straight to a FilterExpression.
+func (f listFilter) expression() *string {
+	if len(f.conditions) == 0 {
+		return nil
+	}
+	return aws.String(strings.Join(f.conditions, " AND "))
+}
+
+// projectionExpression returns nil when every attribute should be read.
+func (f listFilter) projectionExpression() *string {
+	if f.projection == "" {
+		return nil
+	}
+	return aws.String(f.projection)
+}
+
+// attributeNames and attributeValues return nil for empty maps, which
+// DynamoDB rejects.
+func (f listFilter) attributeNames() map[string]string {
+	if len(f.names) == 0 {
+		return nil
+	}
+	return f.names
+}
+
+func (f listFilter) attributeValues() map[string]types.AttributeValue {
+	if len(f.values) == 0 {
+		return nil
+	}
+	return f.values
+}
+
+// makeIndex is the GSI keyed on Make, defined in the Pulumi stack.
+const makeIndex = "MakeIndex"
+
+// listPage fetches up to limit matching items. With LIST_TIME_BUDGET_MS
+// unset it makes a single DynamoDB call, so a selective filter can return
+// fewer items than limit. With a budget it keeps reading until the page is
+// full, the table is exhausted or the budget is spent; in the last case it
+// reports partial and the caller returns what was gathered with a nextToken.
+// The budget is soft: a read already in flight is allowed to finish, and the
+// hard bound remains DB_TIMEOUT_MS.
+func (a *App) listPage(ctx context.Context, table, carMake string, f listFilter, limit int32, startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, bool, error) {
+	budget := listTimeBudget()
+	if budget == 0 {
+		items, lastKey, err := a.listItems(ctx, table, carMake, f, limit, startKey)
+		return items, lastKey, false, err
+	}
+
+	start := time.Now()
+	var items []map[string]types.AttributeValue
+	for {
+		page, lastKey, err := a.listItems(ctx, table, carMake, f, limit-int32(len(items)), startKey)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		items = append(items, page...)
+		if len(lastKey) == 0 || int32(len(items)) >= limit {
+			return items, lastKey, false, nil
+		}
+		if time.Since(start) >= budget {
+			return items, lastKey, true, nil
+		}
+		startKey = lastKey
+	}
+}
+
+// listTimeBudget reads LIST_TIME_BUDGET_MS; 0 disables the budget.
+func listTimeBudget() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("LIST_TIME_BUDGET_MS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return 0
+}
+
+// listItems fetches one page of list results. When carMake is given it
+// queries MakeIndex rather than scanning the whole table; f is applied as a
+// filter either way.
+func (a *App) listItems(ctx context.Context, table, carMake string, f listFilter, limit int32, startKey map[string]types.AttributeValue) ([]map[string]types.AttributeValue, map[string]types.AttributeValue, error) {
+	if carMake == "" {
+		out, err := a.db.Scan(ctx, &dynamodb.ScanInput{
+			TableName:                 &table,
+			Limit:                     &limit,
+			ExclusiveStartKey:         startKey,
+			FilterExpression:          f.expression(),
+			ProjectionExpression:      f.projectionExpression(),
+			ExpressionAttributeNames:  f.attributeNames(),
+			ExpressionAttributeValues: f.attributeValues(),
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		return out.Items, out.LastEvaluatedKey, nil
+	}
+
+	f.names["#make"] = "Make"
+	f.values[":make"] = &types.AttributeValueMemberS{Value: carMake}
+	out, err := a.db.Query(ctx, &dynamodb.QueryInput{
+		TableName:                 &table,
+		IndexName:                 aws.String(makeIndex),
+		KeyConditionExpression:    aws.String("#make = :make"),
+		FilterExpression:          f.expression(),
+		ProjectionExpression:      f.projectionExpression(),
+		ExpressionAttributeNames:  f.names,
+		ExpressionAttributeValues: f.values,
+		Limit:                     &limit,
+		ExclusiveStartKey:         startKey,
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return out.Items, out.LastEvaluatedKey, nil
+}
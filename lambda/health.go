@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/smithy-go"
+)
+
+// healthCheckTimeout bounds each dependency check.
+const healthCheckTimeout = 2 * time.Second
+
+type checkResult struct {
+	Status    string `json:"status"`
+	Critical  bool   `json:"critical"`
+	LatencyMs int64  `json:"latencyMs"`
+}
+
+type livenessReport struct {
+	Status string `json:"status"`
+	Table  string `json:"table"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks"`
+}
+
+// handleHealthDetailed serves GET /health/detailed, checking each dependency
+// and answering 200 only when every critical check passes, 503 otherwise.
+//
+// By default only the cheap DynamoDB read check runs. ?deep=true adds the
+// checks that write or touch other services (a DynamoDB write to the
+// counters table, and the export bucket when EXPORT_BUCKET is set); it
+// requires the ADMIN_TOKEN bearer token like /metrics. Failures are logged
+// in full and reported only as "fail".
+func (a *App) handleHealthDetailed(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	deep := req.QueryStringParameters["deep"] == "true"
+	if deep {
+		if resp, ok := requireAdmin(ctx, req); !ok {
+			return resp, nil
+		}
+	}
+
+	report := healthReport{Status: "ok", Checks: map[string]checkResult{}}
+	run := func(name string, critical bool, check func(context.Context) error) {
+		cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		defer cancel()
+		start := time.Now()
+		err := check(cctx)
+		result := checkResult{Status: "ok", Critical: critical, LatencyMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			loggerFrom(ctx).Warn("health check failed", "check", name, "error", err)
+			result.Status = "fail"
+			switch {
+			case critical:
+				report.Status = "fail"
+			case report.Status == "ok":
+				report.Status = "degraded"
+			}
+		}
+		report.Checks[name] = result
+	}
+
+	run("dynamodb_read", true, a.checkDynamoRead)
+	if deep {
+		run("dynamodb_write", true, a.checkDynamoWrite)
+		if os.Getenv("EXPORT_BUCKET") != "" {
+			run("s3_exports", false, checkExportBucket)
+		}
+	}
+
+	status := http.StatusOK
+	if report.Status == "fail" {
+		status = http.StatusServiceUnavailable
+	}
+	body, _ := json.Marshal(report)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+	}, nil
+}
+
+// handleHealth serves GET /health, a cheap liveness probe: a DescribeTable
+// on TABLE_NAME bounded by healthCheckTimeout. It answers 200 when the table
+// is reachable and 503 otherwise. The error is reported by its AWS error
+// code (or "timeout") only, since the endpoint is unauthenticated and has to
+// stay so for readiness probes; the full error is logged.
+func (a *App) handleHealth(ctx context.Context) (events.APIGatewayV2HTTPResponse, error) {
+	table := a.table
+	report := livenessReport{Status: "ok", Table: table}
+	status := http.StatusOK
+
+	cctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	err := errors.New("TABLE_NAME environment variable is not set")
+	if table != "" {
+		_, err = a.db.DescribeTable(cctx, &dynamodb.DescribeTableInput{TableName: &table})
+	}
+	if err != nil {
+		loggerFrom(ctx).Warn("health check failed", "check", "describe_table", "error", err)
+		report.Status = "fail"
+		report.Error = "unavailable"
+		var apiErr smithy.APIError
+		switch {
+		case errors.Is(err, context.DeadlineExceeded):
+			report.Error = "timeout"
+		case errors.As(err, &apiErr):
+			report.Error = apiErr.ErrorCode()
+		}
+		status = http.StatusServiceUnavailable
+	}
+
+	body, _ := json.Marshal(report)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json", "Cache-Control": "no-store"},
+	}, nil
+}
+
+// checkDynamoRead reads a key that never exists, which costs the minimum
+// read capacity while still exercising the table and credentials.
+func (a *App) checkDynamoRead(ctx context.Context) error {
+	table := a.table
+	if table == "" {
+		return errors.New("TABLE_NAME environment variable is not set")
+	}
+	_, err := a.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: "__health__"},
+		},
+		ProjectionExpression: aws.String("ID"),
+	})
+	return err
+}
+
+// checkDynamoWrite stamps a healthCheck item in the counters table rather
+// than touching the cars table.
+func (a *App) checkDynamoWrite(ctx context.Context) error {
+	table := os.Getenv("COUNTERS_TABLE_NAME")
+	if table == "" {
+		return errors.New("COUNTERS_TABLE_NAME environment variable is not set")
+	}
+	_, err := a.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"Name": &types.AttributeValueMemberS{Value: "healthCheck"},
+		},
+		UpdateExpression:         aws.String("SET #t = :now"),
+		ExpressionAttributeNames: map[string]string{"#t": "CheckedAt"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberS{Value: nowTimestamp()},
+		},
+	})
+	return err
+}
+
+func checkExportBucket(ctx context.Context) error {
+	bucket := os.Getenv("EXPORT_BUCKET")
+	_, err := s3Client.HeadBucket(ctx, &s3.HeadBucketInput{Bucket: &bucket})
+	return err
+}
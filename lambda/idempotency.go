@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// A POST carrying an Idempotency-Key header is recorded in
+// IDEMPOTENCY_TABLE_NAME under that key. A retry with the same key within
+// IDEMPOTENCY_TTL_HOURS gets the original 201 (or 202 for an async write)
+// replayed with its Location and ETag, marked with Idempotent-Replayed:
+// true, instead of creating a second car.
+//
+// The key is claimed with a conditional write before the car is created, so
+// of two concurrent requests with the same key only one goes ahead; the
+// other gets 409 IDEMPOTENCY_IN_PROGRESS and can retry. A claim whose
+// request fails is released so the client can retry with the same key, and
+// a claim left behind by a crashed invocation lapses after
+// idempotencyClaimLease. Reusing a key with a different body is 422.
+const (
+	defaultIdempotencyTTL = 24 * time.Hour
+	idempotencyClaimLease = time.Minute
+)
+
+// idempotentPost runs handle under the request's Idempotency-Key, or just
+// runs it when there is no key or no table.
+func (a *App) idempotentPost(ctx context.Context, req events.APIGatewayV2HTTPRequest, handle func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)) (events.APIGatewayV2HTTPResponse, error) {
+	key := req.Headers["idempotency-key"]
+	table := os.Getenv("IDEMPOTENCY_TABLE_NAME")
+	if key == "" || table == "" {
+		return handle(ctx, req)
+	}
+	if len(key) > 255 {
+		return errorResponse(http.StatusBadRequest, "INVALID_HEADER", "Idempotency-Key must be at most 255 characters"), nil
+	}
+
+	sum := sha256.Sum256([]byte(req.Body))
+	bodyHash := hex.EncodeToString(sum[:])
+	now := time.Now()
+	_, err := a.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: &table,
+		Item: map[string]types.AttributeValue{
+			"Key":       &types.AttributeValueMemberS{Value: key},
+			"BodyHash":  &types.AttributeValueMemberS{Value: bodyHash},
+			"Status":    &types.AttributeValueMemberS{Value: "pending"},
+			"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Add(idempotencyClaimLease).Unix(), 10)},
+		},
+		// TTL eviction is lazy, so an expired record counts as absent.
+		ConditionExpression:      aws.String("attribute_not_exists(#k) OR #exp < :now"),
+		ExpressionAttributeNames: map[string]string{"#k": "Key", "#exp": "ExpiresAt"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":now": &types.AttributeValueMemberN{Value: strconv.FormatInt(now.Unix(), 10)},
+		},
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return replayIdempotent(ccf.Item, bodyHash), nil
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	resp, err := handle(ctx, req)
+	if err != nil || (resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusAccepted) {
+		a.releaseIdempotencyKey(ctx, table, key)
+		return resp, err
+	}
+	a.saveIdempotentResponse(ctx, table, key, resp)
+	return resp, nil
+}
+
+// replayIdempotent answers a request whose key is already recorded.
+func replayIdempotent(record map[string]types.AttributeValue, bodyHash string) events.APIGatewayV2HTTPResponse {
+	if stringAttr(record, "BodyHash") != bodyHash {
+		return errorResponse(http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED", "Idempotency-Key was already used with a different request body")
+	}
+	if stringAttr(record, "Status") != "done" {
+		return errorResponse(http.StatusConflict, "IDEMPOTENCY_IN_PROGRESS", "a request with this Idempotency-Key is still in progress, please retry")
+	}
+	status, _ := strconv.Atoi(numberAttr(record, "StatusCode"))
+	headers := map[string]string{"Content-Type": "application/json", "Idempotent-Replayed": "true"}
+	if location := stringAttr(record, "Location"); location != "" {
+		headers["Location"] = location
+	}
+	if etag := stringAttr(record, "ETag"); etag != "" {
+		headers["ETag"] = etag
+	}
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: status,
+		Body:       stringAttr(record, "Body"),
+		Headers:    headers,
+	}
+}
+
+// saveIdempotentResponse completes the claim with the response to replay.
+// The car already exists, so a failure is only logged; a retry then gets
+// 409 from the claim until it lapses, and 409 ALREADY_EXISTS after that
+// when the client sent its own id.
+func (a *App) saveIdempotentResponse(ctx context.Context, table, key string, resp events.APIGatewayV2HTTPResponse) {
+	_, err := a.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: key},
+		},
+		UpdateExpression: aws.String("SET #status = :done, #code = :code, #body = :body, #location = :location, #etag = :etag, #exp = :exp"),
+		ExpressionAttributeNames: map[string]string{
+			"#status":   "Status",
+			"#code":     "StatusCode",
+			"#body":     "Body",
+			"#location": "Location",
+			"#etag":     "ETag",
+			"#exp":      "ExpiresAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":done":     &types.AttributeValueMemberS{Value: "done"},
+			":code":     &types.AttributeValueMemberN{Value: strconv.Itoa(resp.StatusCode)},
+			":body":     &types.AttributeValueMemberS{Value: resp.Body},
+			":location": &types.AttributeValueMemberS{Value: resp.Headers["Location"]},
+			":etag":     &types.AttributeValueMemberS{Value: resp.Headers["ETag"]},
+			":exp":      &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(idempotencyTTL()).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		loggerFrom(ctx).Error("saving idempotent response failed", "key", key, "error", err)
+	}
+}
+
+func (a *App) releaseIdempotencyKey(ctx context.Context, table, key string) {
+	_, err := a.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"Key": &types.AttributeValueMemberS{Value: key},
+		},
+	})
+	if err != nil {
+		loggerFrom(ctx).Warn("releasing idempotency key failed", "key", key, "error", err)
+	}
+}
+
+// idempotencyTTL reads IDEMPOTENCY_TTL_HOURS, falling back to
+// defaultIdempotencyTTL when it is unset or invalid.
+func idempotencyTTL() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("IDEMPOTENCY_TTL_HOURS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Hour
+	}
+	return defaultIdempotencyTTL
+}
+
+// numberAttr returns the named number attribute as its string form, or ""
+// when it is missing or not a number.
+func numberAttr(item map[string]types.AttributeValue, name string) string {
+	if n, ok := item[name].(*types.AttributeValueMemberN); ok {
+		return n.Value
+	}
+	return ""
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"crypto/rand"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+)
+
+// IDs for cars created without one are random UUIDv4s by default. With
+// ID_FORMAT=ulid they are ULIDs instead: 26 characters whose lexicographic
+// order follows creation time, so sorting on ID lists the most recent cars
+// last without a separate timestamp index. ULIDs from one container are
+// strictly increasing even within the same millisecond; across containers
+// they are ordered to the millisecond only.
+var ulidSource = struct {
+	sync.Mutex
+	entropy *ulid.MonotonicEntropy
+}{entropy: ulid.Monotonic(rand.Reader, 0)}
+
+func newCarID() string {
+	if os.Getenv("ID_FORMAT") != "ulid" {
+		return uuid.NewString()
+	}
+	ulidSource.Lock()
+	defer ulidSource.Unlock()
+	return ulid.MustNew(ulid.Timestamp(time.Now()), ulidSource.entropy).String()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// GET-by-id results can be cached per container to smooth over DynamoDB
+// latency blips. ITEM_CACHE_TTL_SECONDS enables the cache (it is off by
+// default); an entry younger than that is served as is. With
+// ITEM_CACHE_SWR_SECONDS set, an entry up to that much older still is served
+// immediately while a refresh runs in the background (stale-while-revalidate);
+// past that window the read goes to DynamoDB.
+//
+// Writes made by this container drop the affected entries, but writes
+// through other containers aren't seen until an entry expires, so the TTL is
+// also the staleness bound. Every invalidation bumps the cache generation,
+// and a read that started under an older generation doesn't store what it
+// got, so a refresh racing a write can't put the pre-write item back. The background refresh isn't awaited: if Lambda
+// freezes the container before it finishes it resumes, or times out and is
+// retried, on the next invocation.
+var itemCache = struct {
+	sync.Mutex
+	entries    map[string]*cachedItem
+	generation uint64
+}{entries: map[string]*cachedItem{}}
+
+type cachedItem struct {
+	item       map[string]types.AttributeValue
+	loadedAt   time.Time
+	refreshing bool
+}
+
+// getItemCached returns the item with the given id, or nil if there is none,
+// going through the item cache when it is enabled. Missing items are not
+// cached.
+func (a *App) getItemCached(ctx context.Context, table, id string) (map[string]types.AttributeValue, error) {
+	ttl := envSeconds("ITEM_CACHE_TTL_SECONDS")
+	if ttl == 0 {
+		return a.fetchItem(ctx, table, id)
+	}
+	swr := envSeconds("ITEM_CACHE_SWR_SECONDS")
+
+	itemCache.Lock()
+	gen := itemCache.generation
+	entry, ok := itemCache.entries[id]
+	if ok {
+		age := time.Since(entry.loadedAt)
+		switch {
+		case age <= ttl:
+			itemCache.Unlock()
+			return entry.item, nil
+		case age <= ttl+swr:
+			if !entry.refreshing {
+				entry.refreshing = true
+				go a.refreshCachedItem(table, id, gen)
+			}
+			itemCache.Unlock()
+			return entry.item, nil
+		}
+	}
+	itemCache.Unlock()
+
+	item, err := a.fetchItem(ctx, table, id)
+	if err != nil {
+		return nil, err
+	}
+	storeCachedItem(id, item, gen)
+	return item, nil
+}
+
+func (a *App) refreshCachedItem(table, id string, gen uint64) {
+	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout())
+	defer cancel()
+	item, err := a.fetchItem(ctx, table, id)
+	if err != nil {
+		slog.Warn("item cache refresh failed", "id", id, "error", err)
+		itemCache.Lock()
+		if entry, ok := itemCache.entries[id]; ok {
+			entry.refreshing = false
+		}
+		itemCache.Unlock()
+		return
+	}
+	storeCachedItem(id, item, gen)
+}
+
+// storeCachedItem caches item, read under generation gen. A read that an
+// invalidation overtook is dropped, and the entry it was refreshing, if
+// any, may be refreshed again.
+func storeCachedItem(id string, item map[string]types.AttributeValue, gen uint64) {
+	itemCache.Lock()
+	defer itemCache.Unlock()
+	if gen != itemCache.generation {
+		if entry, ok := itemCache.entries[id]; ok {
+			entry.refreshing = false
+		}
+		return
+	}
+	if item == nil {
+		delete(itemCache.entries, id)
+		return
+	}
+	itemCache.entries[id] = &cachedItem{item: item, loadedAt: time.Now()}
+}
+
+// invalidateCachedItems drops the given ids from the item cache, or every
+// entry when called with none.
+func invalidateCachedItems(ids ...string) {
+	itemCache.Lock()
+	defer itemCache.Unlock()
+	itemCache.generation++
+	if len(ids) == 0 {
+		clear(itemCache.entries)
+		return
+	}
+	for _, id := range ids {
+		delete(itemCache.entries, id)
+	}
+}
+
+func (a *App) fetchItem(ctx context.Context, table, id string) (map[string]types.AttributeValue, error) {
+	out, err := a.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName: &table,
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// envSeconds reads a non-negative number of seconds from the named
+// variable, returning 0 when it is unset or invalid.
+func envSeconds(name string) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return 0
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// JSON:API (https://jsonapi.org) output for clients that send
+// Accept: application/vnd.api+json, or for every client when
+// RESPONSE_FORMAT=jsonapi. Like problemDetails, it is applied by handler to
+// the finished response: car and list bodies become resource documents and
+// error envelopes become JSON:API error objects. Anything else, such as
+// stats or the delete preview, is passed through untouched.
+const jsonAPIMediaType = "application/vnd.api+json"
+
+type jsonAPIResource struct {
+	Type       string  `json:"type"`
+	ID         string  `json:"id"`
+	Attributes carAttr `json:"attributes"`
+}
+
+// carAttr is a Car without its id, which JSON:API keeps at the top level of
+// the resource object.
+type carAttr struct {
+	Make      string `json:"make"`
+	Model     string `json:"model"`
+	Year      int    `json:"year"`
+	ChangeSeq int64  `json:"changeSeq,omitempty"`
+	CreatedAt string `json:"createdAt,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty"`
+	Version   int    `json:"version"`
+}
+
+type jsonAPIError struct {
+	Status string `json:"status"`
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func wantsJSONAPI(req events.APIGatewayV2HTTPRequest) bool {
+	if os.Getenv("RESPONSE_FORMAT") == "jsonapi" {
+		return true
+	}
+	return strings.Contains(req.Headers["accept"], jsonAPIMediaType)
+}
+
+func carResource(c Car) jsonAPIResource {
+	return jsonAPIResource{
+		Type: "car",
+		ID:   c.ID,
+		Attributes: carAttr{
+			Make:      c.Make,
+			Model:     c.Model,
+			Year:      c.Year,
+			ChangeSeq: c.ChangeSeq,
+			CreatedAt: c.CreatedAt,
+			UpdatedAt: c.UpdatedAt,
+			Version:   c.Version,
+		},
+	}
+}
+
+// jsonAPIResponse rewrites a JSON response into JSON:API form. A body with
+// an "items" array is a list, one with an "id" a single car, and one with an
+// "error" object an error; list extras such as nextToken move into meta.
+func jsonAPIResponse(resp events.APIGatewayV2HTTPResponse) events.APIGatewayV2HTTPResponse {
+	if resp.Headers["Content-Type"] != "application/json" {
+		return resp
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(resp.Body), &fields); err != nil {
+		return resp
+	}
+
+	var doc any
+	switch {
+	case fields["error"] != nil:
+		var env errorEnvelope
+		if err := json.Unmarshal([]byte(resp.Body), &env); err != nil {
+			return resp
+		}
+		doc = map[string][]jsonAPIError{"errors": {{
+			Status: strconv.Itoa(resp.StatusCode),
+			Code:   env.Error.Code,
+			Title:  http.StatusText(resp.StatusCode),
+			Detail: env.Error.Message,
+		}}}
+	case fields["items"] != nil:
+		var cars []Car
+		if err := json.Unmarshal(fields["items"], &cars); err != nil {
+			return resp
+		}
+		data := make([]jsonAPIResource, 0, len(cars))
+		for _, c := range cars {
+			data = append(data, carResource(c))
+		}
+		delete(fields, "items")
+		list := map[string]any{"data": data}
+		if len(fields) > 0 {
+			list["meta"] = fields
+		}
+		doc = list
+	case fields["id"] != nil:
+		var c Car
+		if err := json.Unmarshal([]byte(resp.Body), &c); err != nil {
+			return resp
+		}
+		doc = map[string]jsonAPIResource{"data": carResource(c)}
+	default:
+		return resp
+	}
+
+	body, _ := json.Marshal(doc)
+	resp.Body = string(body)
+	resp.Headers["Content-Type"] = jsonAPIMediaType
+	return resp
+}
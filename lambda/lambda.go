@@ -1,203 +1,496 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log/slog"
+	"math"
 	"net/http"
-	"strconv"
+	"net/url"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
 	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
 )
 
-var db *dynamodb.Client
+// defaultMaxQueryStringBytes is the longest raw query string accepted when
+// MAX_QUERY_STRING_BYTES is not set.
+const defaultMaxQueryStringBytes = 8 * 1024
 
-func init() {
+// maxIDLength bounds client-supplied car ids.
+const maxIDLength = 256
+
+// initAWS loads the AWS config, creates the clients and returns the App
+// serving requests. It runs from main rather than init so the package can be
+// loaded without AWS access.
+func initAWS() *App {
 	// Load AWS config (uses Lambda execution role by default)
 	cfg, err := config.LoadDefaultConfig(context.Background())
 	if err != nil {
 		panic(fmt.Sprintf("unable to load AWS SDK config, %v", err))
 	}
-	db = dynamodb.NewFromConfig(cfg)
+	// Shared config may set any variable read below, LOG_LEVEL included.
+	initConfig(cfg)
+	initLogging()
+	initTracing(&cfg)
+	initSecrets(cfg)
+	app := &App{
+		db: dynamodb.NewFromConfig(cfg, func(o *dynamodb.Options) {
+			o.Retryer = newDBRetryer()
+			o.APIOptions = append(o.APIOptions, withOperationTimeout)
+		}),
+		table: os.Getenv("TABLE_NAME"),
+	}
+	initReplica()
+	initExport(cfg)
+	initAsyncWrites(cfg)
+	initAuthGuard()
+	return app
 }
 
-
 type Car struct {
-	ID		string `json:"id"`
-	Make	string `json:"make"`
-	Model	string `json:"model"`
-	Year	int    `json:"year"`
+	ID    string `json:"id" dynamodbav:"ID"`
+	Make  string `json:"make" dynamodbav:"Make"`
+	Model string `json:"model" dynamodbav:"Model"`
+	Year  int    `json:"year" dynamodbav:"Year"`
+
+	// ChangeSeq orders the car in the change feed; it's set by the server on
+	// every write. ChangeFeed is the constant partition key of ChangeIndex.
+	ChangeSeq  int64  `json:"changeSeq,omitempty" dynamodbav:"ChangeSeq,omitempty"`
+	ChangeFeed string `json:"-" dynamodbav:"ChangeFeed,omitempty"`
+
+	// CreatedAt and UpdatedAt are RFC 3339 UTC timestamps set by the server:
+	// both on create, only UpdatedAt on later writes.
+	CreatedAt string `json:"createdAt,omitempty" dynamodbav:"CreatedAt,omitempty"`
+	UpdatedAt string `json:"updatedAt,omitempty" dynamodbav:"UpdatedAt,omitempty"`
+
+	// Deleted and DeletedAt mark a soft-deleted car; see softDeleteEnabled.
+	Deleted   bool   `json:"deleted,omitempty" dynamodbav:"Deleted,omitempty"`
+	DeletedAt string `json:"deletedAt,omitempty" dynamodbav:"DeletedAt,omitempty"`
+
+	// Version starts at 1 on create and is bumped by every update, which
+	// must name the version it was based on. Cars written before versioning
+	// read as 0.
+	Version int `json:"version" dynamodbav:"Version,omitempty"`
+}
+
+var errYearNotWhole = errors.New("year must be a whole number")
+
+// UnmarshalJSON decodes year through json.Number so that a fractional value
+// like 2020.5 is reported as errYearNotWhole instead of a generic type error.
+func (c *Car) UnmarshalJSON(data []byte) error {
+	type plain Car
+	aux := struct {
+		Year json.Number `json:"year"`
+		*plain
+	}{plain: (*plain)(c)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	if aux.Year == "" {
+		return nil
+	}
+	if year, err := strconv.Atoi(aux.Year.String()); err == nil {
+		c.Year = year
+		return nil
+	}
+	f, err := aux.Year.Float64()
+	if err != nil || f != math.Trunc(f) || f > math.MaxInt32 || f < math.MinInt32 {
+		return errYearNotWhole
+	}
+	c.Year = int(f)
+	return nil
+}
+
+func (a *App) handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	start := time.Now()
+	logger := slog.Default().With("requestId", req.RequestContext.RequestID)
+	logger.Debug("request body", "body", req.Body)
+	ctx = withRequestID(ctx, req.RequestContext.RequestID)
+	ctx = withLogger(ctx, logger)
+	resp, err := a.route(ctx, req)
+	replicaWrites.Wait()
+	elapsed := time.Since(start)
+	recordRequest(req.RequestContext.HTTP.Method, resp.StatusCode, elapsed)
+	emitRequestMetrics(req.RequestContext.HTTP.Method, resp.StatusCode, elapsed)
+	logger.Info("request",
+		"method", req.RequestContext.HTTP.Method,
+		"path", req.RequestContext.HTTP.Path,
+		"status", resp.StatusCode,
+		"id", carID(req),
+		"latencyMs", elapsed.Milliseconds(),
+		"tlsVersion", cmp.Or(viewerTLSVersion(req), "unknown"),
+	)
+	if err != nil {
+		return resp, err
+	}
+	if wantsJSONAPI(req) {
+		resp = jsonAPIResponse(resp)
+	} else if wantsProblemDetails(req) {
+		resp = problemDetails(resp, req)
+	}
+	// ?debug=true echoes the API Gateway route that matched, e.g. to tell
+	// "GET /" apart from "$default".
+	if req.QueryStringParameters["debug"] == "true" {
+		if resp.Headers == nil {
+			resp.Headers = map[string]string{}
+		}
+		resp.Headers["X-Route-Key"] = req.RequestContext.RouteKey
+	}
+	return compressResponse(signResponse(ctx, withCORS(resp, req.Headers["origin"])), req.Headers["accept-encoding"]), nil
 }
 
-func handler(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	fmt.Println("Received request:", req.RequestContext.HTTP.Method, req.RequestContext.HTTP.Path)
-	fmt.Printf("Raw request body: %s\n", req.Body)
+// route dispatches a request to the handler for its method and path.
+func (a *App) route(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	// Refuse connections negotiated below MIN_TLS_VERSION.
+	if resp, ok := checkTLSVersion(req); !ok {
+		return resp, nil
+	}
+	// Reject huge query strings (e.g. a long ids= list) up front, before any
+	// of them gets parsed.
+	if len(req.RawQueryString) > maxQueryStringBytes() {
+		return errorResponse(http.StatusRequestURITooLong, "QUERY_TOO_LONG", "query string too long"), nil
+	}
+	if writesBlocked && isWriteMethod(req.RequestContext.HTTP.Method) {
+		return errorResponse(http.StatusForbidden, "WRITES_DISABLED", "writes are disabled on this unauthenticated endpoint"), nil
+	}
+	if req.RequestContext.HTTP.Method != "OPTIONS" && req.RequestContext.HTTP.Path != "/metrics" && req.RequestContext.HTTP.Path != "/health" && req.RequestContext.HTTP.Path != "/health/detailed" {
+		if resp, ok := a.tableReady(ctx); !ok {
+			return resp, nil
+		}
+	}
+	if includeDeleted(req) {
+		if resp, ok := requireAdmin(ctx, req); !ok {
+			return resp, nil
+		}
+	}
 	switch req.RequestContext.HTTP.Method {
 	case "GET":
-		return handleGet(ctx, req)
+		switch req.RequestContext.HTTP.Path {
+		case "/stats/by-year":
+			return a.handleStatsByYear(ctx, req)
+		case "/changes":
+			return a.handleChanges(ctx, req)
+		case "/stream":
+			return a.handleStream(ctx, req)
+		case "/count":
+			return a.handleCount(ctx, req)
+		case "/health":
+			return a.handleHealth(ctx)
+		case "/health/detailed":
+			return a.handleHealthDetailed(ctx, req)
+		case "/metrics":
+			return handleMetrics(ctx, req)
+		}
+		if strings.HasPrefix(req.RequestContext.HTTP.Path, "/writes/") {
+			return a.handleWriteStatus(ctx, req.PathParameters["id"])
+		}
+		return a.handleGet(ctx, req)
 	case "POST":
-		return handlePost(ctx, req)
-	default:
+		switch req.RequestContext.HTTP.Path {
+		case "/export":
+			return a.handleExport(ctx, req)
+		case "/batch":
+			return a.handleBatchPost(ctx, req)
+		case "/cars/reserve":
+			return a.handleReserve(ctx)
+		}
+		return a.idempotentPost(ctx, req, a.handlePost)
+	case "PATCH":
+		return a.handlePatch(ctx, req)
+	case "PUT":
+		return a.handlePut(ctx, req)
+	case "DELETE":
+		return a.handleDelete(ctx, req)
+	case "OPTIONS":
+		// CORS preflight; withCORS adds the Access-Control-Allow-* headers.
 		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusMethodNotAllowed,
-			Body:       "method not allowed",
+			StatusCode: http.StatusNoContent,
 		}, nil
+	default:
+		return errorResponse(http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "method not allowed"), nil
 	}
 }
 
+func (a *App) handleGet(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	id := carID(req)
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
 
+	if ids := req.QueryStringParameters["ids"]; ids != "" {
+		return a.handleBatchGet(ctx, TableNameEnv, ids, includeDeleted(req))
+	}
 
-func handleGet(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
-	id := req.QueryStringParameters["id"]
-	TableNameEnv := os.Getenv("TABLE_NAME")
-	if TableNameEnv == "" {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       "TABLE_NAME environment variable is not set",
-		}, nil
+	fields, err := parseFields(req.QueryStringParameters["fields"])
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+	}
+	if fields != nil && includeDeleted(req) && !slices.Contains(fields, "deleted") {
+		fields = append(fields, "deleted")
+	}
+
+	if id == "" && req.QueryStringParameters["count"] == "true" {
+		return a.handleCount(ctx, req)
 	}
 
 	if id == "" {
-		// No id provided, scan the whole table
-		out, err := db.Scan(ctx, &dynamodb.ScanInput{
-			TableName: &TableNameEnv,
-		})
+		// No id provided, list the table one page at a time
+		limit, err := parseLimit(req.QueryStringParameters["limit"])
 		if err != nil {
+			return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+		}
+		startKey, err := decodeNextToken(req.QueryStringParameters["nextToken"])
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", "invalid nextToken"), nil
+		}
+		filter, err := buildListFilter(req.QueryStringParameters)
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+		}
+		order, err := parseSort(req.QueryStringParameters["sort"], req.QueryStringParameters["order"])
+		if err != nil {
+			return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+		}
+		if r, ok := parseItemsRange(req.Headers["range"]); ok {
+			return a.listRange(ctx, TableNameEnv, req.QueryStringParameters["make"], filter, r)
+		}
+		if fields != nil {
+			// The sort attribute has to be read even when it isn't returned.
+			projected := fields
+			if order.field != "" && !slices.Contains(fields, order.field) {
+				projected = append(slices.Clone(fields), order.field)
+			}
+			filter.project(projected)
+		}
+		items, lastKey, partial, err := a.listPage(ctx, TableNameEnv, req.QueryStringParameters["make"], filter, limit, startKey)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		order.apply(items)
+		nextToken, err := encodeNextToken(lastKey)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		var body []byte
+		if fields != nil {
+			page := map[string]any{"items": sparseItems(items, fields)}
+			if nextToken != "" {
+				page["nextToken"] = nextToken
+			}
+			if partial {
+				page["partial"] = true
+			}
+			body, _ = json.Marshal(page)
+		} else {
+			body, _ = json.Marshal(carPage{Items: decodeCars(items), NextToken: nextToken, Partial: partial})
+		}
+		etag := contentETag(body)
+		if etagMatches(req.Headers["if-none-match"], etag) {
 			return events.APIGatewayV2HTTPResponse{
-				StatusCode: http.StatusInternalServerError,
-				Body:       err.Error(),
+				StatusCode: http.StatusNotModified,
+				Headers:    map[string]string{"ETag": etag},
 			}, nil
 		}
-		cars := []Car{}
-		for _, item := range out.Items {
-			year := 0
-			if y, ok := item["Year"].(*types.AttributeValueMemberN); ok {
-				year, _ = strconv.Atoi(y.Value)
-			}
-			cars = append(cars, Car{
-				ID:    item["ID"].(*types.AttributeValueMemberS).Value,
-				Make:  item["Make"].(*types.AttributeValueMemberS).Value,
-				Model: item["Model"].(*types.AttributeValueMemberS).Value,
-				Year:  year,
-			})
-		}
-		body, _ := json.Marshal(cars)
 		return events.APIGatewayV2HTTPResponse{
 			StatusCode: http.StatusOK,
 			Body:       string(body),
-			Headers:    map[string]string{"Content-Type": "application/json"},
+			Headers:    map[string]string{"Content-Type": "application/json", "Accept-Ranges": "items", "ETag": etag},
 		}, nil
 	}
 
 	// id provided, get single item
-	out, err := db.GetItem(ctx, &dynamodb.GetItemInput{
-		TableName: &TableNameEnv,
-		Key: map[string]types.AttributeValue{
-			"ID": &types.AttributeValueMemberS{Value: id},
-		},
-	})
+	raw, err := a.getItemCached(ctx, TableNameEnv, id)
 	if err != nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}, nil
+		return dbErrorResponse(ctx, err), nil
 	}
-	if out.Item == nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusNotFound,
-			Body:       "item not found",
-		}, nil
+	if raw == nil || isDraft(raw) || (isSoftDeleted(raw) && !includeDeleted(req)) {
+		return errorResponse(http.StatusNotFound, "NOT_FOUND", "item not found"), nil
 	}
-	year := 0
-	if y, ok := out.Item["Year"].(*types.AttributeValueMemberN); ok {
-		year, _ = strconv.Atoi(y.Value)
+	var body []byte
+	if fields != nil {
+		body, _ = json.Marshal(sparseItems([]map[string]types.AttributeValue{raw}, fields)[0])
 	} else {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       "invalid year field",
-		}, nil
-	}
-	item := Car{
-		ID:    out.Item["ID"].(*types.AttributeValueMemberS).Value,
-		Make:  out.Item["Make"].(*types.AttributeValueMemberS).Value,
-		Model: out.Item["Model"].(*types.AttributeValueMemberS).Value,
-		Year:  year,
+		item, err := decodeCar(raw)
+		if err != nil {
+			return handleInternalError(ctx, err), nil
+		}
+		body, _ = json.Marshal(item)
 	}
-	body, _ := json.Marshal(item)
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: http.StatusOK,
 		Body:       string(body),
-		Headers:    map[string]string{"Content-Type": "application/json"},
+		Headers:    map[string]string{"Content-Type": "application/json", "ETag": itemETag(raw)},
 	}, nil
 }
 
-func handlePost(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+func (a *App) handlePost(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	var item Car
-	if err := json.Unmarshal([]byte(req.Body), &item); err != nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusBadRequest,
-			Body:       "invalid request body",
-		}, nil
+	if err := json.Unmarshal([]byte(req.Body), &item); errors.Is(err, errYearNotWhole) {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", err.Error()), nil
+	} else if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "invalid request body"), nil
+	}
+	if err := item.Validate(); err != nil {
+		return validationResponse(err), nil
 	}
 
-	TableNameEnv := os.Getenv("TABLE_NAME")
+	TableNameEnv := a.table
 	if TableNameEnv == "" {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       "TABLE_NAME environment variable is not set",
-		}, nil
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
 	}
 
-	_, err := db.PutItem(ctx, &dynamodb.PutItemInput{
-		TableName: &TableNameEnv,
-		Item: map[string]types.AttributeValue{
-			"ID":   &types.AttributeValueMemberS{Value: item.ID},
-			"Make": &types.AttributeValueMemberS{Value: item.Make},
-			"Model": &types.AttributeValueMemberS{Value: item.Model},
-			"Year":  &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", item.Year)},
-		},
-	})
+	// Generate an ID when the client didn't send one, otherwise an empty
+	// string would become a real key and be overwritten by every such POST.
+	if item.ID == "" {
+		item.ID = newCarID()
+	}
+	if len(item.ID) > maxIDLength {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", fmt.Sprintf("id must be at most %d characters", maxIDLength)), nil
+	}
+
+	if asyncWritesEnabled() {
+		return a.enqueueCar(ctx, item)
+	}
+
+	err := a.createCar(ctx, TableNameEnv, &item)
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errorResponse(http.StatusConflict, "ALREADY_EXISTS", fmt.Sprintf("car with id %s already exists", item.ID)), nil
+	}
+	if errors.Is(err, errMakeModelTaken) {
+		return errorResponse(http.StatusConflict, "DUPLICATE_MAKE_MODEL", errMakeModelTaken.Error()), nil
+	}
 	if err != nil {
-		return events.APIGatewayV2HTTPResponse{
-			StatusCode: http.StatusInternalServerError,
-			Body:       err.Error(),
-		}, nil
+		return dbErrorResponse(ctx, err), nil
 	}
 
+	body, _ := json.Marshal(item)
 	return events.APIGatewayV2HTTPResponse{
 		StatusCode: http.StatusCreated,
-		Body:       fmt.Sprintf("item %s created", item.ID),
-		Headers:    map[string]string{"Content-Type": "text/plain"},
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+			"Location":     "/cars/" + url.PathEscape(item.ID),
+			"ETag":         carETag(item.Version),
+		},
 	}, nil
 }
 
+// createCar stamps a new car with its server-set fields and writes it. POST
+// only creates; overwriting an existing car has to be explicit, so a car
+// with the same id fails with *types.ConditionalCheckFailedException, one
+// with the same make and model with errMakeModelTaken.
+func (a *App) createCar(ctx context.Context, table string, item *Car) error {
+	seq, err := a.nextChangeSeq(ctx)
+	if err != nil {
+		return err
+	}
+	item.ChangeSeq = seq
+	item.ChangeFeed = changeFeedName
+	item.CreatedAt = nowTimestamp()
+	item.UpdatedAt = item.CreatedAt
+	item.Version = 1
+	item.Deleted, item.DeletedAt = false, ""
+
+	av, err := attributevalue.MarshalMap(item)
+	if err != nil {
+		return err
+	}
+	if err := a.putNewCar(ctx, table, av, item.Make, item.Model, item.ID); err != nil {
+		return err
+	}
+	mirrorPut(av)
+	return nil
+}
+
 // Helpers
-func serverError(err error) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusInternalServerError,
-		Body:       err.Error(),
-	}, nil
+
+// decodeCar converts a stored item into a Car. Items written outside the API
+// can be missing attributes or have unexpected types, so the required string
+// attributes are checked before unmarshalling and a descriptive error is
+// returned instead of a zero-valued car.
+func decodeCar(item map[string]types.AttributeValue) (Car, error) {
+	id, _ := item["ID"].(*types.AttributeValueMemberS)
+	for _, attr := range []string{"ID", "Make", "Model"} {
+		if _, ok := item[attr].(*types.AttributeValueMemberS); !ok {
+			if id != nil {
+				return Car{}, fmt.Errorf("malformed item %q: %s is missing or not a string", id.Value, attr)
+			}
+			return Car{}, fmt.Errorf("malformed item: %s is missing or not a string", attr)
+		}
+	}
+	var car Car
+	if err := attributevalue.UnmarshalMap(item, &car); err != nil {
+		return Car{}, fmt.Errorf("malformed item %q: %w", id.Value, err)
+	}
+	return car, nil
 }
 
-func clientError(status int, msg string) (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{
-		StatusCode: status,
-		Body:       msg,
-	}, nil
+// decodeCars converts a page of items, logging and skipping malformed ones so
+// a single bad record doesn't fail the whole list.
+func decodeCars(items []map[string]types.AttributeValue) []Car {
+	cars := make([]Car, 0, len(items))
+	for _, item := range items {
+		car, err := decodeCar(item)
+		if err != nil {
+			slog.Warn("skipping malformed item", "error", err)
+			continue
+		}
+		cars = append(cars, car)
+	}
+	return cars
 }
 
-func notFound() (events.APIGatewayProxyResponse, error) {
-	return events.APIGatewayProxyResponse{
-		StatusCode: http.StatusNotFound,
-		Body:       "item not found",
-	}, nil
+// nowTimestamp formats the current time for CreatedAt and UpdatedAt.
+func nowTimestamp() string {
+	return time.Now().UTC().Format(time.RFC3339)
+}
+
+// carID returns the id of the car a request targets: the {id} path
+// parameter of /cars/{id} when present, otherwise the legacy ?id= query
+// parameter.
+func carID(req events.APIGatewayV2HTTPRequest) string {
+	if id := req.PathParameters["id"]; id != "" {
+		return id
+	}
+	return req.QueryStringParameters["id"]
+}
+
+// maxQueryStringBytes reads MAX_QUERY_STRING_BYTES, falling back to
+// defaultMaxQueryStringBytes when it is unset or invalid.
+func maxQueryStringBytes() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_QUERY_STRING_BYTES")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxQueryStringBytes
 }
 
 func main() {
-	lambda.Start(handler)
+	app := initAWS()
+	if streamingMode() {
+		lambda.Start(app.streamingHandler)
+		return
+	}
+	if streamProcessorMode() {
+		lambda.Start(streamHandler)
+		return
+	}
+	if writeWorkerMode() {
+		lambda.Start(app.processWrites)
+		return
+	}
+	lambda.Start(withDeadline(withRecovery(app.handler)))
 }
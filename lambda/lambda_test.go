@@ -0,0 +1,2501 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// fakeDynamo is a DynamoAPI whose calls are answered by per-test hooks. An
+// operation without a hook fails the call, so a test notices requests it
+// didn't expect. DescribeTable reports an ACTIVE table by default, and
+// UpdateItem on the counters table hands out change sequences, since nearly
+// every write goes through both.
+type fakeDynamo struct {
+	getItem        func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error)
+	putItem        func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error)
+	updateItem     func(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+	scan           func(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error)
+	batchGetItem   func(*dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error)
+	deleteItem     func(*dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error)
+	query          func(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error)
+	batchWriteItem func(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+	transactWrite  func(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+	// tableStatus is what DescribeTable reports; empty means ACTIVE.
+	tableStatus types.TableStatus
+
+	mu    sync.Mutex
+	seq   int64
+	calls []string
+}
+
+var errUnexpectedCall = errors.New("unexpected DynamoDB call")
+
+func (f *fakeDynamo) record(call string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, call)
+}
+
+func (f *fakeDynamo) called(call string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	n := 0
+	for _, c := range f.calls {
+		if c == call {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeDynamo) GetItem(_ context.Context, in *dynamodb.GetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.GetItemOutput, error) {
+	f.record("GetItem " + *in.TableName)
+	if f.getItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.getItem(in)
+}
+
+func (f *fakeDynamo) PutItem(_ context.Context, in *dynamodb.PutItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	f.record("PutItem " + *in.TableName)
+	if f.putItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.putItem(in)
+}
+
+func (f *fakeDynamo) UpdateItem(_ context.Context, in *dynamodb.UpdateItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.UpdateItemOutput, error) {
+	f.record("UpdateItem " + *in.TableName)
+	if *in.TableName == "counters" {
+		n, _ := strconv.ParseInt(in.ExpressionAttributeValues[":n"].(*types.AttributeValueMemberN).Value, 10, 64)
+		f.mu.Lock()
+		f.seq += n
+		seq := f.seq
+		f.mu.Unlock()
+		return &dynamodb.UpdateItemOutput{Attributes: map[string]types.AttributeValue{
+			"Value": &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)},
+		}}, nil
+	}
+	if f.updateItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.updateItem(in)
+}
+
+func (f *fakeDynamo) DeleteItem(_ context.Context, in *dynamodb.DeleteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.DeleteItemOutput, error) {
+	f.record("DeleteItem " + *in.TableName)
+	if f.deleteItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.deleteItem(in)
+}
+
+func (f *fakeDynamo) Query(_ context.Context, in *dynamodb.QueryInput, _ ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	f.record("Query " + *in.TableName)
+	if f.query == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.query(in)
+}
+
+func (f *fakeDynamo) Scan(_ context.Context, in *dynamodb.ScanInput, _ ...func(*dynamodb.Options)) (*dynamodb.ScanOutput, error) {
+	f.record("Scan " + *in.TableName)
+	if f.scan == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.scan(in)
+}
+
+func (f *fakeDynamo) BatchGetItem(_ context.Context, in *dynamodb.BatchGetItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.BatchGetItemOutput, error) {
+	f.record("BatchGetItem")
+	if f.batchGetItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.batchGetItem(in)
+}
+
+// existingKeys answers BatchGetItem on the cars table with the requested
+// keys that are in ids.
+func existingKeys(ids ...string) func(*dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+	return func(in *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+		var items []map[string]types.AttributeValue
+		for _, key := range in.RequestItems["cars"].Keys {
+			if slices.Contains(ids, key["ID"].(*types.AttributeValueMemberS).Value) {
+				items = append(items, key)
+			}
+		}
+		return &dynamodb.BatchGetItemOutput{Responses: map[string][]map[string]types.AttributeValue{"cars": items}}, nil
+	}
+}
+
+func (f *fakeDynamo) BatchWriteItem(_ context.Context, in *dynamodb.BatchWriteItemInput, _ ...func(*dynamodb.Options)) (*dynamodb.BatchWriteItemOutput, error) {
+	f.record("BatchWriteItem")
+	if f.batchWriteItem == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.batchWriteItem(in)
+}
+
+func (f *fakeDynamo) TransactWriteItems(_ context.Context, in *dynamodb.TransactWriteItemsInput, _ ...func(*dynamodb.Options)) (*dynamodb.TransactWriteItemsOutput, error) {
+	f.record("TransactWriteItems")
+	if f.transactWrite == nil {
+		return nil, errUnexpectedCall
+	}
+	return f.transactWrite(in)
+}
+
+func (f *fakeDynamo) DescribeTable(_ context.Context, in *dynamodb.DescribeTableInput, _ ...func(*dynamodb.Options)) (*dynamodb.DescribeTableOutput, error) {
+	f.record("DescribeTable " + *in.TableName)
+	status := f.tableStatus
+	if status == "" {
+		status = types.TableStatusActive
+	}
+	return &dynamodb.DescribeTableOutput{Table: &types.TableDescription{TableStatus: status}}, nil
+}
+
+// newTestApp returns an App on the cars table backed by fake, and sets the
+// environment the handlers expect.
+func newTestApp(t *testing.T, fake *fakeDynamo) *App {
+	t.Helper()
+	resetTableStatus()
+	t.Cleanup(resetTableStatus)
+	t.Setenv("COUNTERS_TABLE_NAME", "counters")
+	t.Setenv("RETRY_BASE_MS", "1")
+	return &App{db: fake, table: "cars"}
+}
+
+func resetTableStatus() {
+	tableStatusCache.Lock()
+	tableStatusCache.status = ""
+	tableStatusCache.Unlock()
+}
+
+// request builds an API Gateway request; an /cars/{id} path also sets the
+// id path parameter as the route would.
+func request(method, path, body string, headers map[string]string) events.APIGatewayV2HTTPRequest {
+	req := events.APIGatewayV2HTTPRequest{
+		RawPath:               path,
+		Body:                  body,
+		Headers:               map[string]string{},
+		QueryStringParameters: map[string]string{},
+	}
+	req.RequestContext.RequestID = "test-request"
+	req.RequestContext.HTTP.Method = method
+	path, query, _ := strings.Cut(path, "?")
+	req.RequestContext.HTTP.Path = path
+	req.RawQueryString = query
+	for _, kv := range strings.Split(query, "&") {
+		if k, v, ok := strings.Cut(kv, "="); ok {
+			req.QueryStringParameters[k] = v
+		}
+	}
+	if id, ok := strings.CutPrefix(path, "/cars/"); ok && id != "reserve" {
+		req.PathParameters = map[string]string{"id": id}
+	}
+	for k, v := range headers {
+		req.Headers[k] = v
+	}
+	return req
+}
+
+func carItem(id, carMake, model string, year, version int) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ID":      &types.AttributeValueMemberS{Value: id},
+		"Make":    &types.AttributeValueMemberS{Value: carMake},
+		"Model":   &types.AttributeValueMemberS{Value: model},
+		"Year":    &types.AttributeValueMemberN{Value: strconv.Itoa(year)},
+		"Version": &types.AttributeValueMemberN{Value: strconv.Itoa(version)},
+	}
+}
+
+// errorCode returns error.code from an error envelope body.
+func errorCode(t *testing.T, body string) string {
+	t.Helper()
+	var env errorEnvelope
+	if err := json.Unmarshal([]byte(body), &env); err != nil {
+		t.Fatalf("body is not an error envelope: %v: %s", err, body)
+	}
+	return env.Error.Code
+}
+
+func TestHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		req        events.APIGatewayV2HTTPRequest
+		fake       *fakeDynamo
+		wantStatus int
+		wantCode   string
+		wantHeader map[string]string
+		check      func(t *testing.T, body string)
+	}{
+		{
+			name: "list",
+			req:  request("GET", "/", "", nil),
+			fake: &fakeDynamo{scan: func(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				return &dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{
+					carItem("a", "Toyota", "Corolla", 2020, 1),
+					carItem("b", "Opel", "Corsa", 2019, 3),
+				}}, nil
+			}},
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"Content-Type": "application/json"},
+			check: func(t *testing.T, body string) {
+				var page carPage
+				if err := json.Unmarshal([]byte(body), &page); err != nil {
+					t.Fatal(err)
+				}
+				if len(page.Items) != 2 || page.Items[0].ID != "a" || page.Items[1].Model != "Corsa" {
+					t.Errorf("items = %+v", page.Items)
+				}
+				if page.NextToken != "" {
+					t.Errorf("nextToken = %q, want none", page.NextToken)
+				}
+			},
+		},
+		{
+			name: "get by id",
+			req:  request("GET", "/cars/a", "", nil),
+			fake: &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 4)}, nil
+			}},
+			wantStatus: http.StatusOK,
+			wantHeader: map[string]string{"ETag": `"4"`},
+			check: func(t *testing.T, body string) {
+				var car Car
+				if err := json.Unmarshal([]byte(body), &car); err != nil {
+					t.Fatal(err)
+				}
+				if car.ID != "a" || car.Make != "Toyota" || car.Year != 2020 {
+					t.Errorf("car = %+v", car)
+				}
+			},
+		},
+		{
+			name: "get by id not found",
+			req:  request("GET", "/cars/missing", "", nil),
+			fake: &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{}, nil
+			}},
+			wantStatus: http.StatusNotFound,
+			wantCode:   "NOT_FOUND",
+		},
+		{
+			name: "post",
+			req:  request("POST", "/", `{"id":"c","make":"Toyota","model":"Yaris","year":2021}`, nil),
+			fake: &fakeDynamo{putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+				if *in.TableName != "cars" || *in.ConditionExpression != "attribute_not_exists(#id)" {
+					return nil, errUnexpectedCall
+				}
+				return &dynamodb.PutItemOutput{}, nil
+			}},
+			wantStatus: http.StatusCreated,
+			wantHeader: map[string]string{"Location": "/cars/c", "ETag": `"1"`},
+			check: func(t *testing.T, body string) {
+				var car Car
+				if err := json.Unmarshal([]byte(body), &car); err != nil {
+					t.Fatal(err)
+				}
+				if car.ID != "c" || car.Version != 1 || car.ChangeSeq == 0 || car.CreatedAt == "" {
+					t.Errorf("car = %+v", car)
+				}
+			},
+		},
+		{
+			name: "post existing id",
+			req:  request("POST", "/", `{"id":"c","make":"Toyota","model":"Yaris","year":2021}`, nil),
+			fake: &fakeDynamo{putItem: func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+				return nil, &types.ConditionalCheckFailedException{}
+			}},
+			wantStatus: http.StatusConflict,
+			wantCode:   "ALREADY_EXISTS",
+		},
+		{
+			name:       "post malformed body",
+			req:        request("POST", "/", `{"make":`, nil),
+			fake:       &fakeDynamo{},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "INVALID_BODY",
+		},
+		{
+			name:       "post invalid car",
+			req:        request("POST", "/", `{"model":"Yaris","year":2021}`, nil),
+			fake:       &fakeDynamo{},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   "VALIDATION_FAILED",
+		},
+		{
+			name:       "unsupported method",
+			req:        request("TRACE", "/", "", nil),
+			fake:       &fakeDynamo{},
+			wantStatus: http.StatusMethodNotAllowed,
+			wantCode:   "METHOD_NOT_ALLOWED",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, tt.fake)
+			resp, err := app.handler(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("handler returned error: %v", err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(t, resp.Body); code != tt.wantCode {
+					t.Errorf("error code = %q, want %q", code, tt.wantCode)
+				}
+			}
+			for k, want := range tt.wantHeader {
+				if got := resp.Headers[k]; got != want {
+					t.Errorf("header %s = %q, want %q", k, got, want)
+				}
+			}
+			if tt.check != nil {
+				tt.check(t, resp.Body)
+			}
+		})
+	}
+}
+
+func TestSoftDeletedVisibility(t *testing.T) {
+	deleted := carItem("d", "Fiat", "Panda", 2010, 2)
+	deleted["Deleted"] = &types.AttributeValueMemberBOOL{Value: true}
+	getDeleted := func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		return &dynamodb.GetItemOutput{Item: deleted}, nil
+	}
+
+	tests := []struct {
+		name       string
+		adminToken string
+		req        events.APIGatewayV2HTTPRequest
+		wantStatus int
+	}{
+		{"hidden by default", "", request("GET", "/cars/d", "", nil), http.StatusNotFound},
+		{"includeDeleted without admin feature", "", request("GET", "/cars/d?includeDeleted=true", "", nil), http.StatusNotFound},
+		{"includeDeleted without token", "secret", request("GET", "/cars/d?includeDeleted=true", "", nil), http.StatusUnauthorized},
+		{"includeDeleted as admin", "secret", request("GET", "/cars/d?includeDeleted=true", "", map[string]string{"authorization": "Bearer secret"}), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{getItem: getDeleted})
+			t.Setenv("ADMIN_TOKEN", tt.adminToken)
+			resp, _ := app.handler(context.Background(), tt.req)
+			if resp.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+		})
+	}
+
+	t.Run("list shows and marks deleted rows only when requested", func(t *testing.T) {
+		rows := []map[string]types.AttributeValue{carItem("a", "Toyota", "Corolla", 2020, 1), deleted}
+		for _, tt := range []struct {
+			path    string
+			headers map[string]string
+			wantIDs []string
+		}{
+			{"/", nil, []string{"a"}},
+			{"/?includeDeleted=true", map[string]string{"authorization": "Bearer secret"}, []string{"a", "d"}},
+		} {
+			app := newTestApp(t, &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				// Apply the deleted condition the way DynamoDB would.
+				hide := strings.Contains(*in.FilterExpression, "attribute_not_exists(#deleted)")
+				var items []map[string]types.AttributeValue
+				for _, row := range rows {
+					if !hide || !isSoftDeleted(row) {
+						items = append(items, row)
+					}
+				}
+				return &dynamodb.ScanOutput{Items: items}, nil
+			}})
+			t.Setenv("ADMIN_TOKEN", "secret")
+			resp, _ := app.handler(context.Background(), request("GET", tt.path, "", tt.headers))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status = %d: %s", tt.path, resp.StatusCode, resp.Body)
+			}
+			var page carPage
+			if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, car := range page.Items {
+				ids = append(ids, car.ID)
+				if car.Deleted != (car.ID == "d") {
+					t.Errorf("%s: car %s deleted = %v", tt.path, car.ID, car.Deleted)
+				}
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("%s: ids = %v, want %v", tt.path, ids, tt.wantIDs)
+			}
+		}
+	})
+
+	t.Run("list and stream filter deleted rows", func(t *testing.T) {
+		for _, path := range []string{"/", "/stream"} {
+			var filter string
+			app := newTestApp(t, &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				filter = *in.FilterExpression
+				return &dynamodb.ScanOutput{}, nil
+			}})
+			resp, _ := app.handler(context.Background(), request("GET", path, "", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("%s: status = %d: %s", path, resp.StatusCode, resp.Body)
+			}
+			if !strings.Contains(filter, "attribute_not_exists(#deleted)") || !strings.Contains(filter, "attribute_not_exists(#status)") {
+				t.Errorf("%s: filter %q doesn't hide deleted cars and drafts", path, filter)
+			}
+		}
+	})
+}
+
+func TestIdempotentPost(t *testing.T) {
+	const body = `{"id":"i","make":"Toyota","model":"Yaris","year":2021}`
+	sum := sha256.Sum256([]byte(body))
+	done := map[string]types.AttributeValue{
+		"Key":        &types.AttributeValueMemberS{Value: "k1"},
+		"BodyHash":   &types.AttributeValueMemberS{Value: hex.EncodeToString(sum[:])},
+		"Status":     &types.AttributeValueMemberS{Value: "done"},
+		"StatusCode": &types.AttributeValueMemberN{Value: "201"},
+		"Body":       &types.AttributeValueMemberS{Value: `{"id":"i"}`},
+		"Location":   &types.AttributeValueMemberS{Value: "/cars/i"},
+		"ETag":       &types.AttributeValueMemberS{Value: `"1"`},
+	}
+
+	tests := []struct {
+		name       string
+		body       string
+		record     map[string]types.AttributeValue
+		wantStatus int
+		wantCode   string
+	}{
+		{"replays the original response", body, done, http.StatusCreated, ""},
+		{"rejects a different body", `{"id":"j","make":"Toyota","model":"Yaris","year":2021}`, done, http.StatusUnprocessableEntity, "IDEMPOTENCY_KEY_REUSED"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDynamo{putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+				if *in.TableName != "idempotency" {
+					return nil, errUnexpectedCall
+				}
+				return nil, &types.ConditionalCheckFailedException{Item: tt.record}
+			}}
+			app := newTestApp(t, fake)
+			t.Setenv("IDEMPOTENCY_TABLE_NAME", "idempotency")
+
+			resp, _ := app.handler(context.Background(), request("POST", "/", tt.body, map[string]string{"idempotency-key": "k1"}))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(t, resp.Body); code != tt.wantCode {
+					t.Errorf("error code = %q, want %q", code, tt.wantCode)
+				}
+			} else {
+				if resp.Headers["Idempotent-Replayed"] != "true" || resp.Headers["Location"] != "/cars/i" || resp.Headers["ETag"] != `"1"` || resp.Body != `{"id":"i"}` {
+					t.Errorf("replay = %+v", resp)
+				}
+			}
+			if n := fake.called("PutItem cars"); n != 0 {
+				t.Errorf("car written %d times on a replayed key", n)
+			}
+		})
+	}
+}
+
+func TestIdempotentPostSavesETag(t *testing.T) {
+	var saved map[string]types.AttributeValue
+	fake := &fakeDynamo{
+		putItem: func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			return &dynamodb.PutItemOutput{}, nil
+		},
+		updateItem: func(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+			if *in.TableName != "idempotency" {
+				return nil, errUnexpectedCall
+			}
+			saved = in.ExpressionAttributeValues
+			return &dynamodb.UpdateItemOutput{}, nil
+		},
+	}
+	app := newTestApp(t, fake)
+	t.Setenv("IDEMPOTENCY_TABLE_NAME", "idempotency")
+
+	resp, _ := app.handler(context.Background(), request("POST", "/", `{"id":"i","make":"Toyota","model":"Yaris","year":2021}`, map[string]string{"idempotency-key": "k1"}))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+	}
+	if got := saved[":etag"].(*types.AttributeValueMemberS).Value; got != resp.Headers["ETag"] || got == "" {
+		t.Errorf("saved ETag %q, response has %q", got, resp.Headers["ETag"])
+	}
+}
+
+func TestUpdateIfMatch(t *testing.T) {
+	stale := func(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		return nil, &types.ConditionalCheckFailedException{Item: carItem("a", "Toyota", "Corolla", 2020, 2)}
+	}
+	updated := func(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+		if v := in.ExpressionAttributeValues[":version"].(*types.AttributeValueMemberN).Value; v != "2" {
+			return nil, errUnexpectedCall
+		}
+		return &dynamodb.UpdateItemOutput{Attributes: carItem("a", "Toyota", "Corolla", 2021, 3)}, nil
+	}
+
+	tests := []struct {
+		name       string
+		method     string
+		body       string
+		ifMatch    string
+		update     func(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error)
+		wantStatus int
+		wantCode   string
+		wantETag   string
+	}{
+		{"patch without If-Match", "PATCH", `{"year":2021}`, "", nil, http.StatusPreconditionRequired, "PRECONDITION_REQUIRED", ""},
+		{"patch with stale If-Match", "PATCH", `{"year":2021}`, `"1"`, stale, http.StatusPreconditionFailed, "PRECONDITION_FAILED", ""},
+		{"patch with current If-Match", "PATCH", `{"year":2021}`, `"2"`, updated, http.StatusOK, "", `"3"`},
+		{"patch with unparsable If-Match", "PATCH", `{"year":2021}`, "*", nil, http.StatusPreconditionFailed, "PRECONDITION_FAILED", ""},
+		{"put without If-Match", "PUT", `{"make":"Toyota","model":"Corolla","year":2021}`, "", nil, http.StatusPreconditionRequired, "PRECONDITION_REQUIRED", ""},
+		{"put with stale If-Match", "PUT", `{"make":"Toyota","model":"Corolla","year":2021}`, `"1"`, stale, http.StatusPreconditionFailed, "PRECONDITION_FAILED", ""},
+		{"put with current If-Match", "PUT", `{"make":"Toyota","model":"Corolla","year":2021}`, `"2"`, updated, http.StatusOK, "", `"3"`},
+		{"put with mismatched id", "PUT", `{"id":"b","make":"Toyota","model":"Corolla","year":2021}`, `"2"`, nil, http.StatusBadRequest, "INVALID_BODY", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{updateItem: tt.update})
+			headers := map[string]string{}
+			if tt.ifMatch != "" {
+				headers["if-match"] = tt.ifMatch
+			}
+			resp, _ := app.handler(context.Background(), request(tt.method, "/cars/a", tt.body, headers))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantCode != "" {
+				if code := errorCode(t, resp.Body); code != tt.wantCode {
+					t.Errorf("error code = %q, want %q", code, tt.wantCode)
+				}
+			}
+			if got := resp.Headers["ETag"]; got != tt.wantETag {
+				t.Errorf("ETag = %q, want %q", got, tt.wantETag)
+			}
+		})
+	}
+}
+
+func TestBatchPostPartialFailure(t *testing.T) {
+	const body = `[
+		{"id":"a","make":"Toyota","model":"Corolla","year":2020},
+		{"id":"b","model":"Corsa","year":2019},
+		{"id":"c","make":"Opel","model":"Astra","year":2018},
+		{"id":"d","make":"Fiat","model":"Panda","year":2017}
+	]`
+	var calls int
+	fake := &fakeDynamo{batchGetItem: existingKeys(), batchWriteItem: func(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+		calls++
+		if calls > 1 {
+			// The retry of the unprocessed row fails outright.
+			return nil, errors.New("connection reset")
+		}
+		// a and c are written, d comes back unprocessed.
+		var unprocessed []types.WriteRequest
+		for _, r := range in.RequestItems["cars"] {
+			if r.PutRequest.Item["ID"].(*types.AttributeValueMemberS).Value == "d" {
+				unprocessed = append(unprocessed, r)
+			}
+		}
+		return &dynamodb.BatchWriteItemOutput{UnprocessedItems: map[string][]types.WriteRequest{"cars": unprocessed}}, nil
+	}}
+	app := newTestApp(t, fake)
+
+	resp, _ := app.handler(context.Background(), request("POST", "/batch", body, nil))
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %s", resp.StatusCode, resp.Body)
+	}
+	var summary batchSummary
+	if err := json.Unmarshal([]byte(resp.Body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Written != 2 {
+		t.Errorf("written = %d, want 2", summary.Written)
+	}
+	failed := map[string]string{}
+	for _, f := range summary.Failed {
+		failed[strconv.Itoa(f.Index)] = f.Reason
+	}
+	if len(failed) != 2 || failed["1"] == "" || failed["3"] != "write failed" {
+		t.Errorf("failed = %+v, want rows 1 (invalid) and 3 (write failed)", summary.Failed)
+	}
+	// One counter update covers the three valid rows.
+	if n := fake.called("UpdateItem counters"); n != 1 {
+		t.Errorf("change counter updated %d times, want 1", n)
+	}
+	if fake.seq != 3 {
+		t.Errorf("reserved %d change sequences, want 3", fake.seq)
+	}
+}
+
+func TestBatchPostDuplicateIDs(t *testing.T) {
+	const body = `[
+		{"id":"a","make":"Toyota","model":"Corolla","year":2020},
+		{"id":"b","make":"Opel","model":"Astra","year":2018},
+		{"id":"a","make":"Toyota","model":"Yaris","year":2021}
+	]`
+	tests := []struct {
+		name       string
+		mode       string
+		wantStatus int
+		wantModels map[string]string
+	}{
+		{"rejected by default", "", http.StatusBadRequest, nil},
+		{"lenient keeps the last", "lenient", http.StatusCreated, map[string]string{"a": "Yaris", "b": "Astra"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			written := map[string]string{}
+			fake := &fakeDynamo{
+				batchGetItem: existingKeys(),
+				batchWriteItem: func(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+					for _, r := range in.RequestItems["cars"] {
+						written[stringAttr(r.PutRequest.Item, "ID")] = stringAttr(r.PutRequest.Item, "Model")
+					}
+					return &dynamodb.BatchWriteItemOutput{}, nil
+				},
+			}
+			app := newTestApp(t, fake)
+			t.Setenv("BATCH_DUPLICATE_IDS", tt.mode)
+
+			resp, _ := app.handler(context.Background(), request("POST", "/batch", body, nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantModels == nil {
+				if code := errorCode(t, resp.Body); code != "DUPLICATE_IDS" || !strings.Contains(resp.Body, "duplicate ids in batch: a") {
+					t.Errorf("error = %s, want DUPLICATE_IDS naming a", resp.Body)
+				}
+				if fake.called("BatchWriteItem") != 0 {
+					t.Error("a rejected batch was written")
+				}
+				return
+			}
+			var summary batchSummary
+			if err := json.Unmarshal([]byte(resp.Body), &summary); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(summary.Deduplicated, []string{"a"}) {
+				t.Errorf("deduplicated = %v, want [a]", summary.Deduplicated)
+			}
+			if len(written) != len(tt.wantModels) {
+				t.Fatalf("written = %v, want %v", written, tt.wantModels)
+			}
+			for id, model := range tt.wantModels {
+				if written[id] != model {
+					t.Errorf("car %s written as %q, want %q", id, written[id], model)
+				}
+			}
+		})
+	}
+}
+
+func TestTableInitializing(t *testing.T) {
+	tests := []struct {
+		status     types.TableStatus
+		wantStatus int
+	}{
+		{types.TableStatusCreating, http.StatusServiceUnavailable},
+		{types.TableStatusUpdating, http.StatusOK},
+		{types.TableStatusActive, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.status), func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{tableStatus: tt.status, getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 1)}, nil
+			}})
+			resp, _ := app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				if code := errorCode(t, resp.Body); code != "TABLE_INITIALIZING" {
+					t.Errorf("error code = %q", code)
+				}
+				if resp.Headers["Retry-After"] == "" {
+					t.Error("no Retry-After")
+				}
+			}
+		})
+	}
+}
+
+func TestBatchPostExistingIDs(t *testing.T) {
+	const body = `[
+		{"id":"a","make":"Toyota","model":"Corolla","year":2020},
+		{"id":"taken","make":"Opel","model":"Astra","year":2018},
+		{"id":"draft","make":"Fiat","model":"Panda","year":2017}
+	]`
+	var written []string
+	fake := &fakeDynamo{
+		batchGetItem: existingKeys("taken", "draft"),
+		batchWriteItem: func(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, r := range in.RequestItems["cars"] {
+				written = append(written, r.PutRequest.Item["ID"].(*types.AttributeValueMemberS).Value)
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	app := newTestApp(t, fake)
+
+	resp, _ := app.handler(context.Background(), request("POST", "/batch", body, nil))
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %s", resp.StatusCode, resp.Body)
+	}
+	var summary batchSummary
+	if err := json.Unmarshal([]byte(resp.Body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary.Written != 1 || !slices.Equal(written, []string{"a"}) {
+		t.Errorf("written = %d %v, want only a", summary.Written, written)
+	}
+	if len(summary.Failed) != 2 {
+		t.Fatalf("failed = %+v", summary.Failed)
+	}
+	for _, f := range summary.Failed {
+		if f.Code != "ALREADY_EXISTS" || (f.ID != "taken" && f.ID != "draft") {
+			t.Errorf("failure = %+v, want ALREADY_EXISTS for taken and draft", f)
+		}
+	}
+	// Only the new car takes a change sequence.
+	if fake.seq != 1 {
+		t.Errorf("reserved %d change sequences, want 1", fake.seq)
+	}
+}
+
+func TestListModelSubstring(t *testing.T) {
+	cars := []map[string]types.AttributeValue{
+		carItem("a", "Toyota", "Corolla", 2020, 1),
+		carItem("b", "Opel", "Corsa", 2019, 1),
+		carItem("c", "Toyota", "Yaris", 2021, 1),
+	}
+	var filter string
+	app := newTestApp(t, &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+		filter = *in.FilterExpression
+		// Apply the model condition the way DynamoDB would.
+		model := in.ExpressionAttributeValues[":model"].(*types.AttributeValueMemberS).Value
+		var items []map[string]types.AttributeValue
+		for _, car := range cars {
+			if strings.Contains(stringAttr(car, "Model"), model) {
+				items = append(items, car)
+			}
+		}
+		return &dynamodb.ScanOutput{Items: items}, nil
+	}})
+
+	resp, _ := app.handler(context.Background(), request("GET", "/?model=Cor", "", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+	}
+	if !strings.Contains(filter, "contains(#model, :model)") {
+		t.Errorf("filter %q doesn't match model as a substring", filter)
+	}
+	var page carPage
+	if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+		t.Fatal(err)
+	}
+	var models []string
+	for _, car := range page.Items {
+		models = append(models, car.Model)
+	}
+	if !slices.Equal(models, []string{"Corolla", "Corsa"}) {
+		t.Errorf("models = %v, want Corolla and Corsa", models)
+	}
+}
+
+func TestListMakeFilter(t *testing.T) {
+	cars := []map[string]types.AttributeValue{
+		carItem("a", "Toyota", "Corolla", 2020, 1),
+		carItem("b", "Opel", "Corsa", 2019, 1),
+		carItem("c", "Toyota", "Yaris", 2021, 1),
+	}
+	tests := []struct {
+		name    string
+		path    string
+		wantOp  string
+		wantIDs []string
+	}{
+		{"matching make", "/?make=Toyota", "Query cars", []string{"a", "c"}},
+		{"case-sensitive", "/?make=toyota", "Query cars", nil},
+		{"absent returns all", "/", "Scan cars", []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDynamo{
+				query: func(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+					if in.IndexName == nil || *in.IndexName != makeIndex || *in.KeyConditionExpression != "#make = :make" {
+						t.Errorf("query = %+v, want #make = :make on %s", in, makeIndex)
+					}
+					// Index keys match exactly, as DynamoDB's do.
+					carMake := in.ExpressionAttributeValues[":make"].(*types.AttributeValueMemberS).Value
+					var items []map[string]types.AttributeValue
+					for _, car := range cars {
+						if stringAttr(car, "Make") == carMake {
+							items = append(items, car)
+						}
+					}
+					return &dynamodb.QueryOutput{Items: items}, nil
+				},
+				scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+					if in.FilterExpression != nil && strings.Contains(*in.FilterExpression, "#make") {
+						t.Errorf("unfiltered list has a make condition: %s", *in.FilterExpression)
+					}
+					return &dynamodb.ScanOutput{Items: cars}, nil
+				},
+			}
+			app := newTestApp(t, fake)
+
+			resp, _ := app.handler(context.Background(), request("GET", tt.path, "", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+			}
+			if fake.called(tt.wantOp) != 1 {
+				t.Errorf("calls = %v, want one %s", fake.calls, tt.wantOp)
+			}
+			var page carPage
+			if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, car := range page.Items {
+				ids = append(ids, car.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestBulkDeleteConfirmation(t *testing.T) {
+	// tokens stands in for the confirmation table.
+	tokens := map[string]map[string]types.AttributeValue{}
+	var deleted []string
+	fake := &fakeDynamo{
+		query: func(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+			if *in.IndexName != makeIndex || in.ExpressionAttributeValues[":m"].(*types.AttributeValueMemberS).Value != "Toyota" {
+				return nil, errUnexpectedCall
+			}
+			return &dynamodb.QueryOutput{Items: []map[string]types.AttributeValue{
+				{"ID": &types.AttributeValueMemberS{Value: "a"}},
+				{"ID": &types.AttributeValueMemberS{Value: "b"}},
+			}}, nil
+		},
+		putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			tokens[stringAttr(in.Item, "Token")] = in.Item
+			return &dynamodb.PutItemOutput{}, nil
+		},
+		deleteItem: func(in *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+			token := stringAttr(in.Key, "Token")
+			item, ok := tokens[token]
+			if !ok {
+				return nil, &types.ConditionalCheckFailedException{}
+			}
+			delete(tokens, token)
+			return &dynamodb.DeleteItemOutput{Attributes: item}, nil
+		},
+		batchWriteItem: func(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+			for _, r := range in.RequestItems["cars"] {
+				deleted = append(deleted, stringAttr(r.DeleteRequest.Key, "ID"))
+			}
+			return &dynamodb.BatchWriteItemOutput{}, nil
+		},
+	}
+	app := newTestApp(t, fake)
+	t.Setenv("CONFIRM_TABLE_NAME", "confirm")
+
+	del := func(query string) (events.APIGatewayV2HTTPResponse, map[string]any) {
+		t.Helper()
+		resp, _ := app.handler(context.Background(), request("DELETE", "/?"+query, "", nil))
+		var body map[string]any
+		json.Unmarshal([]byte(resp.Body), &body)
+		return resp, body
+	}
+
+	// The preview counts the cars and hands out a token without deleting.
+	resp, preview := del("make=Toyota")
+	if resp.StatusCode != http.StatusConflict || preview["count"] != 2.0 || preview["confirmToken"] == "" {
+		t.Fatalf("preview = %d %s", resp.StatusCode, resp.Body)
+	}
+	if len(deleted) != 0 {
+		t.Fatalf("preview deleted %v", deleted)
+	}
+	token := preview["confirmToken"].(string)
+
+	// A token for another make doesn't delete anything.
+	if resp, _ := del("make=Opel&confirmToken=" + token); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("token for another make: status = %d", resp.StatusCode)
+	}
+
+	resp, preview = del("make=Toyota")
+	token = preview["confirmToken"].(string)
+	resp, body := del("make=Toyota&confirmToken=" + token)
+	if resp.StatusCode != http.StatusOK || body["deleted"] != 2.0 {
+		t.Fatalf("confirm = %d %s", resp.StatusCode, resp.Body)
+	}
+	if !slices.Equal(deleted, []string{"a", "b"}) {
+		t.Errorf("deleted %v, want a and b", deleted)
+	}
+	if _, ok := tokens[token]; ok {
+		t.Error("token not consumed")
+	}
+
+	// A consumed token can't be replayed.
+	if resp, _ := del("make=Toyota&confirmToken=" + token); resp.StatusCode != http.StatusBadRequest || errorCode(t, resp.Body) != "INVALID_CONFIRM_TOKEN" {
+		t.Errorf("reused token: %d %s", resp.StatusCode, resp.Body)
+	}
+
+	// Nor can one past its expiry that TTL hasn't evicted yet.
+	tokens["old"] = map[string]types.AttributeValue{
+		"Token":     &types.AttributeValueMemberS{Value: "old"},
+		"Make":      &types.AttributeValueMemberS{Value: "Toyota"},
+		"ExpiresAt": &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)},
+	}
+	if resp, _ := del("make=Toyota&confirmToken=old"); resp.StatusCode != http.StatusBadRequest || errorCode(t, resp.Body) != "INVALID_CONFIRM_TOKEN" {
+		t.Errorf("expired token: %d %s", resp.StatusCode, resp.Body)
+	}
+	if len(deleted) != 2 {
+		t.Errorf("rejected tokens deleted cars: %v", deleted)
+	}
+	if n := fake.called("Scan cars"); n != 0 {
+		t.Errorf("bulk delete scanned the table %d times", n)
+	}
+}
+
+func TestListRange(t *testing.T) {
+	var cars []map[string]types.AttributeValue
+	for i := range 5 {
+		cars = append(cars, carItem("car"+strconv.Itoa(i), "Toyota", "Corolla", 2020, 1))
+	}
+	tests := []struct {
+		name        string
+		rangeHeader string
+		maxRangeEnd string
+		wantStatus  int
+		wantRange   string
+		wantIDs     []string
+		wantNoReads bool
+	}{
+		{"slice", "items=1-2", "", http.StatusPartialContent, "items 1-2/5", []string{"car1", "car2"}, false},
+		{"past the end is shortened", "items=3-10", "", http.StatusPartialContent, "items 3-4/5", []string{"car3", "car4"}, false},
+		{"starts past the last item", "items=5-9", "", http.StatusRequestedRangeNotSatisfiable, "items */5", nil, false},
+		{"shortened at MAX_RANGE_END", "items=0-9", "3", http.StatusPartialContent, "items 0-2/5", []string{"car0", "car1", "car2"}, false},
+		{"huge range end is shortened", "items=0-9999999", "", http.StatusPartialContent, "items 0-4/5", []string{"car0", "car1", "car2", "car3", "car4"}, false},
+		{"deep range refused without reading", "items=5000-5009", "", http.StatusRequestedRangeNotSatisfiable, "items */*", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+				return &dynamodb.ScanOutput{Items: cars}, nil
+			}}
+			app := newTestApp(t, fake)
+			t.Setenv("MAX_RANGE_END", tt.maxRangeEnd)
+
+			resp, _ := app.handler(context.Background(), request("GET", "/", "", map[string]string{"range": tt.rangeHeader}))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if got := resp.Headers["Content-Range"]; got != tt.wantRange {
+				t.Errorf("Content-Range = %q, want %q", got, tt.wantRange)
+			}
+			if tt.wantNoReads && fake.called("Scan cars") != 0 {
+				t.Error("an unsatisfiable deep range still read the table")
+			}
+			if tt.wantIDs == nil {
+				return
+			}
+			var page carPage
+			if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, car := range page.Items {
+				ids = append(ids, car.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+// seedItemCache puts item in the item cache as loaded age ago and empties
+// the cache again when the test ends.
+func seedItemCache(t *testing.T, id string, item map[string]types.AttributeValue, age time.Duration) {
+	t.Helper()
+	t.Cleanup(func() { invalidateCachedItems() })
+	itemCache.Lock()
+	itemCache.entries[id] = &cachedItem{item: item, loadedAt: time.Now().Add(-age)}
+	itemCache.Unlock()
+}
+
+func cachedVersion(id string) (string, bool) {
+	itemCache.Lock()
+	defer itemCache.Unlock()
+	entry, ok := itemCache.entries[id]
+	if !ok {
+		return "", false
+	}
+	return numberAttr(entry.item, "Version"), true
+}
+
+func TestItemCacheStaleWhileRevalidate(t *testing.T) {
+	refreshed := make(chan struct{})
+	fake := &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		defer close(refreshed)
+		return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2021, 2)}, nil
+	}}
+	app := newTestApp(t, fake)
+	t.Setenv("ITEM_CACHE_TTL_SECONDS", "5")
+	t.Setenv("ITEM_CACHE_SWR_SECONDS", "60")
+	seedItemCache(t, "a", carItem("a", "Toyota", "Corolla", 2020, 1), 10*time.Second)
+
+	// Past the TTL but inside the window: the stale car is served at once.
+	resp, _ := app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+	if resp.StatusCode != http.StatusOK || resp.Headers["ETag"] != `"1"` {
+		t.Fatalf("stale read = %d %s %s", resp.StatusCode, resp.Headers["ETag"], resp.Body)
+	}
+
+	// ...while a refresh runs in the background.
+	select {
+	case <-refreshed:
+	case <-time.After(time.Second):
+		t.Fatal("no background refresh")
+	}
+	deadline := time.Now().Add(time.Second)
+	for v, _ := cachedVersion("a"); v != "2"; v, _ = cachedVersion("a") {
+		if time.Now().After(deadline) {
+			t.Fatalf("cache holds version %q after the refresh", v)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	resp, _ = app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+	if resp.Headers["ETag"] != `"2"` {
+		t.Errorf("ETag after refresh = %s, want \"2\"", resp.Headers["ETag"])
+	}
+	if n := fake.called("GetItem cars"); n != 1 {
+		t.Errorf("GetItem called %d times, want only the refresh", n)
+	}
+}
+
+func TestItemCacheRefreshRacingWrite(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+	app := newTestApp(t, &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		close(started)
+		<-release
+		// The refresh read the car before the write below committed.
+		return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 1)}, nil
+	}})
+	t.Setenv("ITEM_CACHE_TTL_SECONDS", "5")
+	t.Setenv("ITEM_CACHE_SWR_SECONDS", "60")
+	seedItemCache(t, "a", carItem("a", "Toyota", "Corolla", 2020, 1), 10*time.Second)
+
+	app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+	<-started
+	// A PATCH through this container lands while the refresh is in flight.
+	invalidateCachedItems("a")
+	go func() {
+		close(release)
+		// Give the refresh time to store what it read.
+		time.Sleep(50 * time.Millisecond)
+		close(done)
+	}()
+	<-done
+
+	if v, ok := cachedVersion("a"); ok {
+		t.Errorf("refresh stored version %s after the write invalidated it", v)
+	}
+}
+
+// changeFeed answers Query on ChangeIndex with the items whose ChangeSeq is
+// above :since, in sequence order, as the index would.
+func changeFeed(items *[]map[string]types.AttributeValue) func(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+	return func(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		since, _ := strconv.ParseInt(in.ExpressionAttributeValues[":since"].(*types.AttributeValueMemberN).Value, 10, 64)
+		seqOf := func(item map[string]types.AttributeValue) int64 {
+			seq, _ := strconv.ParseInt(item["ChangeSeq"].(*types.AttributeValueMemberN).Value, 10, 64)
+			return seq
+		}
+		var out []map[string]types.AttributeValue
+		for _, item := range *items {
+			if seqOf(item) > since {
+				out = append(out, item)
+			}
+		}
+		slices.SortFunc(out, func(a, b map[string]types.AttributeValue) int {
+			return cmp.Compare(seqOf(a), seqOf(b))
+		})
+		return &dynamodb.QueryOutput{Items: out}, nil
+	}
+}
+
+func changedCar(id string, seq int, updatedAt time.Time) map[string]types.AttributeValue {
+	item := carItem(id, "Toyota", "Corolla", 2020, 1)
+	item["ChangeSeq"] = &types.AttributeValueMemberN{Value: strconv.Itoa(seq)}
+	item["UpdatedAt"] = &types.AttributeValueMemberS{Value: updatedAt.UTC().Format(time.RFC3339)}
+	return item
+}
+
+func TestChangesOutOfOrderCommit(t *testing.T) {
+	now := time.Now()
+	poll := func(t *testing.T, app *App, since int64) changesPage {
+		t.Helper()
+		resp, _ := app.handler(context.Background(), request("GET", "/changes?since="+strconv.FormatInt(since, 10), "", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+		var page changesPage
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	ids := func(page changesPage) []string {
+		var ids []string
+		for _, car := range page.Items {
+			ids = append(ids, car.ID)
+		}
+		return ids
+	}
+
+	t.Run("stops before a fresh gap until it fills", func(t *testing.T) {
+		// Sequence 3 was reserved before 4 but commits after it.
+		feed := []map[string]types.AttributeValue{
+			changedCar("car1", 1, now),
+			changedCar("car2", 2, now),
+			changedCar("car4", 4, now),
+		}
+		app := newTestApp(t, &fakeDynamo{query: changeFeed(&feed)})
+
+		page := poll(t, app, 0)
+		if page.HighWaterMark != 2 || !slices.Equal(ids(page), []string{"car1", "car2"}) {
+			t.Fatalf("first poll = %v up to %d, want [car1 car2] up to 2", ids(page), page.HighWaterMark)
+		}
+
+		feed = append(feed, changedCar("car3", 3, now))
+		page = poll(t, app, page.HighWaterMark)
+		if page.HighWaterMark != 4 || !slices.Equal(ids(page), []string{"car3", "car4"}) {
+			t.Errorf("second poll = %v up to %d, want [car3 car4] up to 4", ids(page), page.HighWaterMark)
+		}
+	})
+
+	t.Run("skips a gap once it has settled", func(t *testing.T) {
+		// Sequence 3 never committed; 4 is older than the settle window.
+		feed := []map[string]types.AttributeValue{
+			changedCar("car2", 2, now.Add(-time.Minute)),
+			changedCar("car4", 4, now.Add(-time.Minute)),
+			changedCar("car5", 5, now),
+		}
+		app := newTestApp(t, &fakeDynamo{query: changeFeed(&feed)})
+		t.Setenv("CHANGES_SETTLE_MS", "5000")
+
+		page := poll(t, app, 1)
+		if page.HighWaterMark != 5 || !slices.Equal(ids(page), []string{"car2", "car4", "car5"}) {
+			t.Errorf("poll = %v up to %d, want [car2 car4 car5] up to 5", ids(page), page.HighWaterMark)
+		}
+	})
+}
+
+func TestContentETagIsCanonical(t *testing.T) {
+	car := Car{ID: "a", Make: "Toyota", Model: "Corolla", Year: 2020, Version: 3}
+	fromStruct, _ := json.Marshal(carPage{Items: []Car{car}})
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"struct order", string(fromStruct)},
+		{"reordered keys", `{"items":[{"year":2020,"version":3,"model":"Corolla","make":"Toyota","id":"a"}]}`},
+		{"extra whitespace", "{ \"items\": [ {\"version\":3, \"id\":\"a\", \"make\":\"Toyota\", \"model\":\"Corolla\", \"year\":2020} ] }"},
+	}
+	want := contentETag(fromStruct)
+	for _, tt := range tests {
+		for range 10 {
+			if got := contentETag([]byte(tt.body)); got != want {
+				t.Fatalf("%s: ETag = %s, want %s", tt.name, got, want)
+			}
+		}
+	}
+	changed, _ := json.Marshal(carPage{Items: []Car{{ID: "a", Make: "Toyota", Model: "Corolla", Year: 2021, Version: 3}}})
+	if contentETag(changed) == want {
+		t.Error("different content has the same ETag")
+	}
+}
+
+func TestListIfNoneMatch(t *testing.T) {
+	app := newTestApp(t, &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+		return &dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{carItem("a", "Toyota", "Corolla", 2020, 1)}}, nil
+	}})
+
+	resp, _ := app.handler(context.Background(), request("GET", "/", "", nil))
+	etag := resp.Headers["ETag"]
+	if resp.StatusCode != http.StatusOK || etag == "" {
+		t.Fatalf("status = %d, ETag = %q", resp.StatusCode, etag)
+	}
+	resp, _ = app.handler(context.Background(), request("GET", "/", "", map[string]string{"if-none-match": `"stale", W/` + etag}))
+	if resp.StatusCode != http.StatusNotModified || resp.Body != "" || resp.Headers["ETag"] != etag {
+		t.Errorf("revalidation = %d %q with ETag %q, want an empty 304 with %s", resp.StatusCode, resp.Body, resp.Headers["ETag"], etag)
+	}
+	resp, _ = app.handler(context.Background(), request("GET", "/", "", map[string]string{"if-none-match": `"stale"`}))
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("stale If-None-Match status = %d, want 200", resp.StatusCode)
+	}
+}
+
+// markerTaken cancels a car+marker transaction the way DynamoDB does when the
+// marker's condition fails.
+func markerTaken(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+	return nil, &types.TransactionCanceledException{CancellationReasons: []types.CancellationReason{
+		{Code: aws.String("None")},
+		{Code: aws.String("ConditionalCheckFailed")},
+	}}
+}
+
+func TestUniqueMakeModel(t *testing.T) {
+	claimed := func(t *testing.T, in *dynamodb.TransactWriteItemsInput, carMake, model string) {
+		t.Helper()
+		if len(in.TransactItems) != 2 || in.TransactItems[1].Put == nil || *in.TransactItems[1].Put.TableName != "markers" {
+			t.Fatalf("transaction = %+v, want the car and a marker", in.TransactItems)
+		}
+		marker := in.TransactItems[1].Put.Item
+		if stringAttr(marker, "Make") != carMake || stringAttr(marker, "Model") != model {
+			t.Errorf("marker = %v, want %s %s", marker, carMake, model)
+		}
+	}
+
+	t.Run("create", func(t *testing.T) {
+		tests := []struct {
+			name       string
+			transact   func(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+			wantStatus int
+		}{
+			{"free pair", func(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+				return &dynamodb.TransactWriteItemsOutput{}, nil
+			}, http.StatusCreated},
+			{"taken pair", markerTaken, http.StatusConflict},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var in *dynamodb.TransactWriteItemsInput
+				fake := &fakeDynamo{transactWrite: func(i *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+					in = i
+					return tt.transact(i)
+				}}
+				app := newTestApp(t, fake)
+				t.Setenv("UNIQUE_MAKE_MODEL", "true")
+				t.Setenv("MAKE_MODEL_TABLE_NAME", "markers")
+
+				resp, _ := app.handler(context.Background(), request("POST", "/", `{"id":"a","make":"Toyota","model":"Corolla","year":2020}`, nil))
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+				}
+				claimed(t, in, "Toyota", "Corolla")
+				if tt.wantStatus == http.StatusConflict {
+					if code := errorCode(t, resp.Body); code != "DUPLICATE_MAKE_MODEL" {
+						t.Errorf("error code = %q, want DUPLICATE_MAKE_MODEL", code)
+					}
+				}
+				if fake.called("PutItem cars") != 0 {
+					t.Error("car written outside the transaction")
+				}
+			})
+		}
+	})
+
+	t.Run("update", func(t *testing.T) {
+		tests := []struct {
+			name        string
+			transact    func(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error)
+			wantStatus  int
+			wantRelease bool
+		}{
+			{"free pair", func(*dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+				return &dynamodb.TransactWriteItemsOutput{}, nil
+			}, http.StatusOK, true},
+			{"taken pair", markerTaken, http.StatusConflict, false},
+		}
+		for _, tt := range tests {
+			t.Run(tt.name, func(t *testing.T) {
+				var in *dynamodb.TransactWriteItemsInput
+				var released map[string]types.AttributeValue
+				fake := &fakeDynamo{
+					getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+						if in != nil {
+							return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Yaris", 2020, 3)}, nil
+						}
+						return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 2)}, nil
+					},
+					transactWrite: func(i *dynamodb.TransactWriteItemsInput) (*dynamodb.TransactWriteItemsOutput, error) {
+						in = i
+						return tt.transact(i)
+					},
+					deleteItem: func(i *dynamodb.DeleteItemInput) (*dynamodb.DeleteItemOutput, error) {
+						released = i.Key
+						return &dynamodb.DeleteItemOutput{}, nil
+					},
+				}
+				app := newTestApp(t, fake)
+				t.Setenv("UNIQUE_MAKE_MODEL", "true")
+				t.Setenv("MAKE_MODEL_TABLE_NAME", "markers")
+
+				resp, _ := app.handler(context.Background(), request("PATCH", "/cars/a", `{"model":"Yaris"}`, map[string]string{"if-match": `"2"`}))
+				if resp.StatusCode != tt.wantStatus {
+					t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+				}
+				claimed(t, in, "Toyota", "Yaris")
+				if tt.wantStatus == http.StatusConflict {
+					if code := errorCode(t, resp.Body); code != "DUPLICATE_MAKE_MODEL" {
+						t.Errorf("error code = %q, want DUPLICATE_MAKE_MODEL", code)
+					}
+				}
+				if !tt.wantRelease {
+					if released != nil {
+						t.Errorf("released %v after a failed update", released)
+					}
+					return
+				}
+				if stringAttr(released, "Make") != "Toyota" || stringAttr(released, "Model") != "Corolla" {
+					t.Errorf("released %v, want the old Toyota Corolla marker", released)
+				}
+			})
+		}
+	})
+}
+
+// draftItem is a reservation from POST /cars/reserve expiring at expiresAt.
+func draftItem(id string, expiresAt time.Time) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"ID":                 &types.AttributeValueMemberS{Value: id},
+		draftStatusAttribute: &types.AttributeValueMemberS{Value: draftStatus},
+		draftExpiryAttribute: &types.AttributeValueMemberN{Value: strconv.FormatInt(expiresAt.Unix(), 10)},
+		"Version":            &types.AttributeValueMemberN{Value: "1"},
+	}
+}
+
+func TestDraftReservation(t *testing.T) {
+	t.Run("reserve", func(t *testing.T) {
+		var stored map[string]types.AttributeValue
+		app := newTestApp(t, &fakeDynamo{putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			stored = in.Item
+			return &dynamodb.PutItemOutput{}, nil
+		}})
+		t.Setenv("DRAFT_TTL_MINUTES", "10")
+
+		before := time.Now()
+		resp, _ := app.handler(context.Background(), request("POST", "/cars/reserve", "", nil))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+		var r reservation
+		if err := json.Unmarshal([]byte(resp.Body), &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.ID == "" || r.ID != stringAttr(stored, "ID") || resp.Headers["Location"] != "/cars/"+r.ID {
+			t.Errorf("reservation %+v at %q doesn't match the stored draft %v", r, resp.Headers["Location"], stored)
+		}
+		if !isDraft(stored) {
+			t.Errorf("stored item %v isn't a draft", stored)
+		}
+		exp, _ := strconv.ParseInt(numberAttr(stored, draftExpiryAttribute), 10, 64)
+		if want := before.Add(10 * time.Minute).Unix(); exp < want || exp > want+1 {
+			t.Errorf("ExpiresAt = %d, want about %d", exp, want)
+		}
+	})
+
+	t.Run("hidden from reads", func(t *testing.T) {
+		app := newTestApp(t, &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{Item: draftItem("d", time.Now().Add(time.Hour))}, nil
+		}})
+		resp, _ := app.handler(context.Background(), request("GET", "/cars/d", "", nil))
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("status = %d, want 404", resp.StatusCode)
+		}
+	})
+
+	const body = `{"make":"Toyota","model":"Corolla","year":2020}`
+	t.Run("promote", func(t *testing.T) {
+		app := newTestApp(t, &fakeDynamo{updateItem: func(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+			if !strings.HasSuffix(*in.UpdateExpression, "REMOVE #status, #expiresAt") {
+				t.Errorf("update %q doesn't clear the draft status and expiry", *in.UpdateExpression)
+			}
+			if !strings.Contains(*in.ConditionExpression, "#expiresAt > :nowEpoch") {
+				t.Errorf("condition %q doesn't refuse lapsed drafts", *in.ConditionExpression)
+			}
+			return &dynamodb.UpdateItemOutput{Attributes: carItem("d", "Toyota", "Corolla", 2020, 2)}, nil
+		}})
+		resp, _ := app.handler(context.Background(), request("PATCH", "/cars/d", body, map[string]string{"if-match": `"1"`}))
+		if resp.StatusCode != http.StatusOK || resp.Headers["ETag"] != `"2"` {
+			t.Errorf("status = %d, ETag = %q: %s", resp.StatusCode, resp.Headers["ETag"], resp.Body)
+		}
+	})
+
+	t.Run("lapsed draft can't be promoted", func(t *testing.T) {
+		app := newTestApp(t, &fakeDynamo{updateItem: func(*dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+			// TTL hasn't evicted it yet, but the expiry condition fails.
+			return nil, &types.ConditionalCheckFailedException{Item: draftItem("d", time.Now().Add(-time.Minute))}
+		}})
+		resp, _ := app.handler(context.Background(), request("PATCH", "/cars/d", body, map[string]string{"if-match": `"1"`}))
+		if resp.StatusCode != http.StatusNotFound {
+			t.Errorf("status = %d, want 404: %s", resp.StatusCode, resp.Body)
+		}
+	})
+}
+
+func TestGzipRoundTrip(t *testing.T) {
+	var cars []map[string]types.AttributeValue
+	for i := range 50 {
+		cars = append(cars, carItem("car"+strconv.Itoa(i), "Toyota", "Corolla", 2020, 1))
+	}
+	app := newTestApp(t, &fakeDynamo{
+		scan: func(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			return &dynamodb.ScanOutput{Items: cars}, nil
+		},
+		getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+			return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 1)}, nil
+		},
+	})
+	plain, _ := app.handler(context.Background(), request("GET", "/", "", nil))
+	if plain.StatusCode != http.StatusOK || plain.IsBase64Encoded || len(plain.Body) < defaultGzipMinBytes {
+		t.Fatalf("uncompressed list = %d, %d bytes, base64 %v", plain.StatusCode, len(plain.Body), plain.IsBase64Encoded)
+	}
+
+	resp, _ := app.handler(context.Background(), request("GET", "/", "", map[string]string{"accept-encoding": "br, gzip"}))
+	if !resp.IsBase64Encoded || resp.Headers["Content-Encoding"] != "gzip" {
+		t.Fatalf("large list not gzipped: base64 %v, Content-Encoding %q", resp.IsBase64Encoded, resp.Headers["Content-Encoding"])
+	}
+	compressed, err := base64.StdEncoding.DecodeString(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != plain.Body {
+		t.Error("decompressed body differs from the uncompressed one")
+	}
+
+	for _, tt := range []struct {
+		name, path, acceptEncoding string
+	}{
+		{"below GZIP_MIN_BYTES", "/cars/a", "gzip"},
+		{"gzip refused", "/", "gzip;q=0"},
+	} {
+		resp, _ := app.handler(context.Background(), request("GET", tt.path, "", map[string]string{"accept-encoding": tt.acceptEncoding}))
+		if resp.IsBase64Encoded || resp.Headers["Content-Encoding"] != "" {
+			t.Errorf("%s: response was compressed", tt.name)
+		}
+	}
+}
+
+func TestSecretFallback(t *testing.T) {
+	t.Setenv("ADMIN_TOKEN", "from-env")
+	t.Setenv("RESPONSE_SIGNING_SECRET", "signing-from-env")
+	if got := secret(context.Background(), "ADMIN_TOKEN"); got != "from-env" {
+		t.Errorf("without SECRETS_ARN ADMIN_TOKEN = %q, want the env var", got)
+	}
+
+	// A fresh cache is served without calling Secrets Manager.
+	t.Setenv("SECRETS_ARN", "arn:aws:secretsmanager:eu-west-1:123456789012:secret:cars-api")
+	prevClient := secretsClient
+	secretsClient = secretsmanager.New(secretsmanager.Options{})
+	secretCache.Lock()
+	secretCache.values = map[string]string{"ADMIN_TOKEN": "from-secret"}
+	secretCache.loadedAt = time.Now()
+	secretCache.Unlock()
+	t.Cleanup(func() {
+		secretsClient = prevClient
+		secretCache.Lock()
+		secretCache.values = nil
+		secretCache.Unlock()
+	})
+
+	if got := secret(context.Background(), "ADMIN_TOKEN"); got != "from-secret" {
+		t.Errorf("ADMIN_TOKEN = %q, want the cached secret", got)
+	}
+	if got := secret(context.Background(), "RESPONSE_SIGNING_SECRET"); got != "signing-from-env" {
+		t.Errorf("RESPONSE_SIGNING_SECRET missing from the secret = %q, want the env var", got)
+	}
+}
+
+func TestAppTable(t *testing.T) {
+	fake := &fakeDynamo{getItem: func(in *dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 1)}, nil
+	}}
+	app := newTestApp(t, fake)
+	app.table = "cars-staging"
+	t.Setenv("TABLE_NAME", "cars-from-env")
+
+	resp, _ := app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+	}
+	if fake.called("GetItem cars-staging") != 1 || fake.called("GetItem cars-from-env") != 0 {
+		t.Errorf("calls = %v, want a read of the App's table", fake.calls)
+	}
+
+	app.table = ""
+	resp, _ = app.handler(context.Background(), request("GET", "/cars/b", "", nil))
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("status without a table = %d, want 500", resp.StatusCode)
+	}
+}
+
+func TestQueryStringTooLong(t *testing.T) {
+	tests := []struct {
+		name       string
+		max        string
+		query      string
+		wantStatus int
+	}{
+		{"over the default", "", "ids=" + strings.Repeat("a,", defaultMaxQueryStringBytes/2), http.StatusRequestURITooLong},
+		{"over MAX_QUERY_STRING_BYTES", "16", "make=Toyota&model=Corolla", http.StatusRequestURITooLong},
+		{"within MAX_QUERY_STRING_BYTES", "32", "make=Toyota&model=Corolla", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDynamo{query: func(*dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+				return &dynamodb.QueryOutput{}, nil
+			}}
+			app := newTestApp(t, fake)
+			t.Setenv("MAX_QUERY_STRING_BYTES", tt.max)
+
+			resp, _ := app.handler(context.Background(), request("GET", "/?"+tt.query, "", nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus != http.StatusRequestURITooLong {
+				return
+			}
+			if code := errorCode(t, resp.Body); code != "QUERY_TOO_LONG" {
+				t.Errorf("error code = %q, want QUERY_TOO_LONG", code)
+			}
+			if len(fake.calls) != 0 {
+				t.Errorf("calls = %v, want none before the length check", fake.calls)
+			}
+		})
+	}
+}
+
+func TestPatchCorruptRow(t *testing.T) {
+	// The row lost its Make; Version matches the If-Match below.
+	corrupt := carItem("a", "Toyota", "Corolla", 2020, 2)
+	delete(corrupt, "Make")
+
+	tests := []struct {
+		name       string
+		required   string
+		wantStatus int
+		wantCode   string
+	}{
+		{"rejected by default", "", http.StatusUnprocessableEntity, "MISSING_ATTRIBUTES"},
+		{"checks disabled", "none", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{updateItem: func(in *dynamodb.UpdateItemInput) (*dynamodb.UpdateItemOutput, error) {
+				// Evaluate the attribute_exists conditions against the row.
+				for placeholder, attr := range in.ExpressionAttributeNames {
+					if _, ok := corrupt[attr]; !ok && strings.Contains(*in.ConditionExpression, "attribute_exists("+placeholder+")") {
+						return nil, &types.ConditionalCheckFailedException{Item: corrupt}
+					}
+				}
+				updated := carItem("a", "", "Corolla", 2021, 3)
+				delete(updated, "Make")
+				return &dynamodb.UpdateItemOutput{Attributes: updated}, nil
+			}})
+			if tt.required != "" {
+				t.Setenv("UPDATE_REQUIRED_ATTRIBUTES", tt.required)
+			}
+
+			resp, _ := app.handler(context.Background(), request("PATCH", "/cars/a", `{"year":2021}`, map[string]string{"if-match": `"2"`}))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantCode == "" {
+				return
+			}
+			if code := errorCode(t, resp.Body); code != tt.wantCode || !strings.Contains(resp.Body, "Make") {
+				t.Errorf("error = %s, want %s naming Make", resp.Body, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestBatchGetIDLimit(t *testing.T) {
+	ids := func(n int) string {
+		list := make([]string, n)
+		for i := range list {
+			list[i] = "c" + strconv.Itoa(i)
+		}
+		return strings.Join(list, ",")
+	}
+	tests := []struct {
+		name       string
+		max        string
+		n          int
+		wantStatus int
+		wantCalls  int
+	}{
+		{"over the default", "", defaultMaxBatchGetIDs + 1, http.StatusRequestEntityTooLarge, 0},
+		{"over MAX_BATCH_GET_IDS", "3", 4, http.StatusRequestEntityTooLarge, 0},
+		{"within the limit in chunks", "", 150, http.StatusOK, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fake := &fakeDynamo{batchGetItem: func(in *dynamodb.BatchGetItemInput) (*dynamodb.BatchGetItemOutput, error) {
+				if n := len(in.RequestItems["cars"].Keys); n > batchGetLimit {
+					t.Errorf("BatchGetItem with %d keys, limit is %d", n, batchGetLimit)
+				}
+				return &dynamodb.BatchGetItemOutput{}, nil
+			}}
+			app := newTestApp(t, fake)
+			t.Setenv("MAX_BATCH_GET_IDS", tt.max)
+
+			resp, _ := app.handler(context.Background(), request("GET", "/?ids="+ids(tt.n), "", nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus == http.StatusRequestEntityTooLarge {
+				if code := errorCode(t, resp.Body); code != "TOO_MANY_IDS" {
+					t.Errorf("error code = %q, want TOO_MANY_IDS", code)
+				}
+			}
+			if got := fake.called("BatchGetItem"); got != tt.wantCalls {
+				t.Errorf("BatchGetItem calls = %d, want %d", got, tt.wantCalls)
+			}
+		})
+	}
+}
+
+// yearFilter applies the :minYear and :maxYear bounds of a list filter to
+// cars the way DynamoDB would.
+func yearFilter(cars []map[string]types.AttributeValue, values map[string]types.AttributeValue) []map[string]types.AttributeValue {
+	var items []map[string]types.AttributeValue
+	for _, car := range cars {
+		year, _ := strconv.Atoi(numberAttr(car, "Year"))
+		if v, ok := values[":minYear"].(*types.AttributeValueMemberN); ok {
+			if bound, _ := strconv.Atoi(v.Value); year < bound {
+				continue
+			}
+		}
+		if v, ok := values[":maxYear"].(*types.AttributeValueMemberN); ok {
+			if bound, _ := strconv.Atoi(v.Value); year > bound {
+				continue
+			}
+		}
+		items = append(items, car)
+	}
+	return items
+}
+
+func TestListYearRange(t *testing.T) {
+	cars := []map[string]types.AttributeValue{
+		carItem("old", "Toyota", "Corolla", 2010, 1),
+		carItem("from2015", "Toyota", "Yaris", 2015, 1),
+		carItem("new", "Opel", "Corsa", 2021, 1),
+	}
+	tests := []struct {
+		name       string
+		path       string
+		wantStatus int
+		wantIDs    []string
+	}{
+		{"minYear only", "/?minYear=2015", http.StatusOK, []string{"from2015", "new"}},
+		{"maxYear only", "/?maxYear=2015", http.StatusOK, []string{"old", "from2015"}},
+		{"both bounds", "/?minYear=2011&maxYear=2020", http.StatusOK, []string{"from2015"}},
+		{"with make", "/?make=Toyota&minYear=2015", http.StatusOK, []string{"from2015"}},
+		{"non-numeric", "/?minYear=recent", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var filter string
+			app := newTestApp(t, &fakeDynamo{
+				scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+					filter = *in.FilterExpression
+					return &dynamodb.ScanOutput{Items: yearFilter(cars, in.ExpressionAttributeValues)}, nil
+				},
+				query: func(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+					filter = *in.FilterExpression
+					carMake := in.ExpressionAttributeValues[":make"].(*types.AttributeValueMemberS).Value
+					var items []map[string]types.AttributeValue
+					for _, car := range yearFilter(cars, in.ExpressionAttributeValues) {
+						if stringAttr(car, "Make") == carMake {
+							items = append(items, car)
+						}
+					}
+					return &dynamodb.QueryOutput{Items: items}, nil
+				},
+			})
+
+			resp, _ := app.handler(context.Background(), request("GET", tt.path, "", nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if tt.wantStatus != http.StatusOK {
+				if code := errorCode(t, resp.Body); code != "INVALID_PARAMETER" {
+					t.Errorf("error code = %q, want INVALID_PARAMETER", code)
+				}
+				return
+			}
+			for param, cond := range map[string]string{"minYear": "#year >= :minYear", "maxYear": "#year <= :maxYear"} {
+				if strings.Contains(tt.path, param+"=") && !strings.Contains(filter, " AND "+cond) {
+					t.Errorf("filter %q doesn't AND in %s", filter, cond)
+				}
+			}
+			var page carPage
+			if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+				t.Fatal(err)
+			}
+			var ids []string
+			for _, car := range page.Items {
+				ids = append(ids, car.ID)
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("ids = %v, want %v", ids, tt.wantIDs)
+			}
+		})
+	}
+}
+
+func TestYearNotWhole(t *testing.T) {
+	tests := []struct {
+		name    string
+		year    string
+		want    int
+		wantErr bool
+	}{
+		{"integer", "2020", 2020, false},
+		{"whole float", "2020.0", 2020, false},
+		{"exponent", "2.02e3", 2020, false},
+		{"fraction", "2020.5", 0, true},
+		{"out of range", "1e20", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var car Car
+			err := json.Unmarshal([]byte(`{"make":"Toyota","model":"Corolla","year":`+tt.year+`}`), &car)
+			if tt.wantErr {
+				if !errors.Is(err, errYearNotWhole) {
+					t.Errorf("error = %v, want errYearNotWhole", err)
+				}
+				return
+			}
+			if err != nil || car.Year != tt.want {
+				t.Errorf("year = %d, %v, want %d", car.Year, err, tt.want)
+			}
+		})
+	}
+
+	app := newTestApp(t, &fakeDynamo{})
+	resp, _ := app.handler(context.Background(), request("POST", "/", `{"make":"Toyota","model":"Corolla","year":2020.5}`, nil))
+	if resp.StatusCode != http.StatusBadRequest || !strings.Contains(resp.Body, "year must be a whole number") {
+		t.Errorf("POST with a float year = %d: %s, want 400 saying year must be a whole number", resp.StatusCode, resp.Body)
+	}
+}
+
+func TestChangesSince(t *testing.T) {
+	settledAt := time.Now().Add(-time.Minute)
+	var feed []map[string]types.AttributeValue
+	for seq := 1; seq <= 5; seq++ {
+		if seq != 4 {
+			feed = append(feed, changedCar("car"+strconv.Itoa(seq), seq, settledAt))
+		}
+	}
+	deletedAt := settledAt.UTC().Format(time.RFC3339)
+	tombstones := []map[string]types.AttributeValue{{
+		"Feed":      &types.AttributeValueMemberS{Value: changeFeedName},
+		"Seq":       &types.AttributeValueMemberN{Value: "4"},
+		"ID":        &types.AttributeValueMemberS{Value: "gone"},
+		"DeletedAt": &types.AttributeValueMemberS{Value: deletedAt},
+	}}
+	items := changeFeed(&feed)
+	app := newTestApp(t, &fakeDynamo{query: func(in *dynamodb.QueryInput) (*dynamodb.QueryOutput, error) {
+		if *in.TableName != "tombstones" {
+			return items(in)
+		}
+		since, _ := strconv.ParseInt(in.ExpressionAttributeValues[":since"].(*types.AttributeValueMemberN).Value, 10, 64)
+		var out []map[string]types.AttributeValue
+		for _, ts := range tombstones {
+			if seq, _ := strconv.ParseInt(numberAttr(ts, "Seq"), 10, 64); seq > since {
+				out = append(out, ts)
+			}
+		}
+		return &dynamodb.QueryOutput{Items: out}, nil
+	}})
+	t.Setenv("TOMBSTONES_TABLE_NAME", "tombstones")
+
+	tests := []struct {
+		since       string
+		wantIDs     []string
+		wantDeleted []string
+		wantMark    int64
+	}{
+		{"0", []string{"car1", "car2", "car3", "car5"}, []string{"gone"}, 5},
+		{"2", []string{"car3", "car5"}, []string{"gone"}, 5},
+		{"4", []string{"car5"}, nil, 5},
+		{"5", nil, nil, 5},
+	}
+	for _, tt := range tests {
+		resp, _ := app.handler(context.Background(), request("GET", "/changes?since="+tt.since, "", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("since=%s: status = %d: %s", tt.since, resp.StatusCode, resp.Body)
+		}
+		var page changesPage
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+			t.Fatal(err)
+		}
+		var ids, deleted []string
+		for _, car := range page.Items {
+			ids = append(ids, car.ID)
+		}
+		for _, ts := range page.Deleted {
+			deleted = append(deleted, ts.ID)
+		}
+		if !slices.Equal(ids, tt.wantIDs) || !slices.Equal(deleted, tt.wantDeleted) || page.HighWaterMark != tt.wantMark {
+			t.Errorf("since=%s: items %v, deleted %v, mark %d; want %v, %v, %d", tt.since, ids, deleted, page.HighWaterMark, tt.wantIDs, tt.wantDeleted, tt.wantMark)
+		}
+	}
+
+	resp, _ := app.handler(context.Background(), request("GET", "/changes?since=-1", "", nil))
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("since=-1: status = %d, want 400", resp.StatusCode)
+	}
+
+	t.Run("writes are stamped", func(t *testing.T) {
+		var stored map[string]types.AttributeValue
+		fake := &fakeDynamo{seq: 5, putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+			stored = in.Item
+			return &dynamodb.PutItemOutput{}, nil
+		}}
+		app := newTestApp(t, fake)
+		resp, _ := app.handler(context.Background(), request("POST", "/", `{"id":"c","make":"Toyota","model":"Yaris","year":2021}`, nil))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+		if numberAttr(stored, "ChangeSeq") != "6" || stringAttr(stored, "ChangeFeed") != changeFeedName {
+			t.Errorf("stored ChangeSeq %q, ChangeFeed %q; want 6 on the %s feed", numberAttr(stored, "ChangeSeq"), stringAttr(stored, "ChangeFeed"), changeFeedName)
+		}
+	})
+}
+
+// doFunc is an HTTP client for SDK clients under test.
+type doFunc func(*http.Request) (*http.Response, error)
+
+func (f doFunc) Do(req *http.Request) (*http.Response, error) { return f(req) }
+
+// dynamoResponse is a DynamoDB JSON protocol response.
+func dynamoResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Header:     http.Header{"Content-Type": {"application/x-amz-json-1.0"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestDynamoInternalServerErrorRetried(t *testing.T) {
+	const internalError = `{"__type":"com.amazonaws.dynamodb.v20120810#InternalServerError","message":"Internal server error"}`
+	tests := []struct {
+		name       string
+		failures   int
+		wantStatus int
+		wantCalls  int
+	}{
+		{"fails once then succeeds", 1, http.StatusOK, 2},
+		{"keeps failing", 10, http.StatusServiceUnavailable, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("DB_MAX_ATTEMPTS", "3")
+			t.Setenv("RETRY_BASE_MS", "1")
+			var mu sync.Mutex
+			getItems := 0
+			client := dynamodb.New(dynamodb.Options{
+				Region:       "eu-west-1",
+				Credentials:  aws.AnonymousCredentials{},
+				BaseEndpoint: aws.String("https://dynamodb.test"),
+				Retryer:      newDBRetryer(),
+				HTTPClient: doFunc(func(req *http.Request) (*http.Response, error) {
+					if req.Header.Get("X-Amz-Target") == "DynamoDB_20120810.DescribeTable" {
+						return dynamoResponse(http.StatusOK, `{"Table":{"TableStatus":"ACTIVE"}}`), nil
+					}
+					mu.Lock()
+					defer mu.Unlock()
+					getItems++
+					if getItems <= tt.failures {
+						return dynamoResponse(http.StatusInternalServerError, internalError), nil
+					}
+					return dynamoResponse(http.StatusOK, `{"Item":{"ID":{"S":"a"},"Make":{"S":"Toyota"},"Model":{"S":"Corolla"},"Year":{"N":"2020"},"Version":{"N":"1"}}}`), nil
+				}),
+			})
+			resetTableStatus()
+			t.Cleanup(resetTableStatus)
+			app := &App{db: client, table: "cars"}
+
+			resp, _ := app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d: %s", resp.StatusCode, tt.wantStatus, resp.Body)
+			}
+			if getItems != tt.wantCalls {
+				t.Errorf("GetItem sent %d times, want %d", getItems, tt.wantCalls)
+			}
+			if tt.wantStatus == http.StatusServiceUnavailable {
+				if code := errorCode(t, resp.Body); code != "DEPENDENCY_UNAVAILABLE" {
+					t.Errorf("error code = %q, want DEPENDENCY_UNAVAILABLE", code)
+				}
+			}
+		})
+	}
+}
+
+func TestMalformedItems(t *testing.T) {
+	noMake := carItem("nomake", "Toyota", "Corolla", 2020, 1)
+	delete(noMake, "Make")
+	badYear := carItem("badyear", "Toyota", "Corolla", 2020, 1)
+	badYear["Year"] = &types.AttributeValueMemberS{Value: "twenty twenty"}
+	noID := carItem("", "Toyota", "Corolla", 2020, 1)
+	delete(noID, "ID")
+
+	t.Run("list skips them", func(t *testing.T) {
+		app := newTestApp(t, &fakeDynamo{scan: func(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			return &dynamodb.ScanOutput{Items: []map[string]types.AttributeValue{
+				noMake, carItem("ok", "Opel", "Corsa", 2019, 1), badYear, noID,
+			}}, nil
+		}})
+		resp, _ := app.handler(context.Background(), request("GET", "/", "", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+		var page carPage
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Items) != 1 || page.Items[0].ID != "ok" {
+			t.Errorf("items = %+v, want only ok", page.Items)
+		}
+	})
+
+	for _, item := range []map[string]types.AttributeValue{noMake, badYear} {
+		id := stringAttr(item, "ID")
+		t.Run("get "+id, func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+				return &dynamodb.GetItemOutput{Item: item}, nil
+			}})
+			resp, _ := app.handler(context.Background(), request("GET", "/cars/"+id, "", nil))
+			if resp.StatusCode != http.StatusInternalServerError {
+				t.Fatalf("status = %d, want 500: %s", resp.StatusCode, resp.Body)
+			}
+			errorCode(t, resp.Body)
+		})
+	}
+}
+
+func TestProblemDetails(t *testing.T) {
+	notFound := func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+		return &dynamodb.GetItemOutput{}, nil
+	}
+	tests := []struct {
+		name        string
+		format      string
+		accept      string
+		wantProblem bool
+	}{
+		{"envelope by default", "", "", false},
+		{"Accept header", "", "application/problem+json", true},
+		{"ERROR_FORMAT=problem", "problem", "application/json", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := newTestApp(t, &fakeDynamo{getItem: notFound})
+			t.Setenv("ERROR_FORMAT", tt.format)
+			headers := map[string]string{}
+			if tt.accept != "" {
+				headers["accept"] = tt.accept
+			}
+
+			resp, _ := app.handler(context.Background(), request("GET", "/cars/missing", "", headers))
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("status = %d, want 404: %s", resp.StatusCode, resp.Body)
+			}
+			if !tt.wantProblem {
+				if resp.Headers["Content-Type"] != "application/json" || errorCode(t, resp.Body) != "NOT_FOUND" {
+					t.Errorf("default error = %s %s, want the NOT_FOUND envelope", resp.Headers["Content-Type"], resp.Body)
+				}
+				return
+			}
+			if got := resp.Headers["Content-Type"]; got != "application/problem+json" {
+				t.Errorf("Content-Type = %q, want application/problem+json", got)
+			}
+			var p map[string]any
+			if err := json.Unmarshal([]byte(resp.Body), &p); err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]any{
+				"type":     "about:blank",
+				"title":    "Not Found",
+				"status":   float64(http.StatusNotFound),
+				"detail":   "item not found",
+				"instance": "/cars/missing",
+				"code":     "NOT_FOUND",
+			}
+			for k, v := range want {
+				if p[k] != v {
+					t.Errorf("%s = %v, want %v", k, p[k], v)
+				}
+			}
+			if _, ok := p["error"]; ok {
+				t.Error("problem details still carry the error envelope")
+			}
+		})
+	}
+}
+
+// stubS3 points s3Client at an in-memory bucket for the rest of the test and
+// returns the objects written to it, keyed by object key.
+func stubS3(t *testing.T, bucket string) map[string]string {
+	t.Helper()
+	var mu sync.Mutex
+	objects := map[string]string{}
+	prevClient := s3Client
+	s3Client = s3.New(s3.Options{
+		Region: "eu-west-1",
+		// Presigning needs credentials to sign with.
+		Credentials: aws.CredentialsProviderFunc(func(context.Context) (aws.Credentials, error) {
+			return aws.Credentials{AccessKeyID: "test", SecretAccessKey: "test"}, nil
+		}),
+		BaseEndpoint: aws.String("https://s3.test"),
+		UsePathStyle: true,
+		HTTPClient: doFunc(func(req *http.Request) (*http.Response, error) {
+			body, err := io.ReadAll(req.Body)
+			if err != nil {
+				return nil, err
+			}
+			mu.Lock()
+			objects[strings.TrimPrefix(req.URL.Path, "/"+bucket+"/")] = string(body)
+			mu.Unlock()
+			return &http.Response{StatusCode: http.StatusOK, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(""))}, nil
+		}),
+	})
+	t.Cleanup(func() { s3Client = prevClient })
+	return objects
+}
+
+func TestExportManifest(t *testing.T) {
+	var cars []map[string]types.AttributeValue
+	for i := range 5 {
+		cars = append(cars, carItem("car"+strconv.Itoa(i), "Toyota", "Corolla", 2020, 1))
+	}
+	// Two scan pages, so parts have to carry over between them.
+	fake := &fakeDynamo{scan: func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+		if in.ExclusiveStartKey == nil {
+			return &dynamodb.ScanOutput{Items: cars[:3], LastEvaluatedKey: map[string]types.AttributeValue{"ID": cars[2]["ID"]}}, nil
+		}
+		return &dynamodb.ScanOutput{Items: cars[3:]}, nil
+	}}
+	app := newTestApp(t, fake)
+	t.Setenv("EXPORT_BUCKET", "exports-bucket")
+	t.Setenv("EXPORT_PAGE_SIZE", "2")
+
+	objects := stubS3(t, "exports-bucket")
+
+	resp, _ := app.handler(context.Background(), request("POST", "/export", "", nil))
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+	}
+	var result struct {
+		ManifestKey string `json:"manifestKey"`
+		ManifestURL string `json:"manifestUrl"`
+		Parts       int    `json:"parts"`
+		Rows        int    `json:"rows"`
+	}
+	if err := json.Unmarshal([]byte(resp.Body), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Parts != 3 || result.Rows != 5 || !strings.Contains(result.ManifestURL, result.ManifestKey) {
+		t.Errorf("result = %+v, want 3 parts, 5 rows and a URL for the manifest", result)
+	}
+
+	var manifest exportManifest
+	if err := json.Unmarshal([]byte(objects[result.ManifestKey]), &manifest); err != nil {
+		t.Fatalf("manifest %q: %v", objects[result.ManifestKey], err)
+	}
+	if manifest.Bucket != "exports-bucket" || manifest.PageSize != 2 || manifest.Rows != 5 {
+		t.Errorf("manifest = %+v", manifest)
+	}
+	var ids []string
+	for _, part := range manifest.Parts {
+		lines := strings.Split(strings.TrimSuffix(objects[part.Key], "\n"), "\n")
+		if len(lines) != part.Rows {
+			t.Errorf("part %s has %d lines, manifest says %d", part.Key, len(lines), part.Rows)
+		}
+		for _, line := range lines {
+			var car Car
+			if err := json.Unmarshal([]byte(line), &car); err != nil {
+				t.Fatalf("part %s: %v", part.Key, err)
+			}
+			ids = append(ids, car.ID)
+		}
+	}
+	if want := []string{"car0", "car1", "car2", "car3", "car4"}; !slices.Equal(ids, want) {
+		t.Errorf("exported ids = %v, want %v", ids, want)
+	}
+	// Every object written is the manifest or one of its parts.
+	if len(objects) != len(manifest.Parts)+1 {
+		t.Errorf("wrote %d objects for %d parts and a manifest", len(objects), len(manifest.Parts))
+	}
+}
+
+func TestUnauthenticatedWrites(t *testing.T) {
+	tests := []struct {
+		name        string
+		authType    string
+		allow       string
+		wantBlocked bool
+	}{
+		{"function URL without auth", "NONE", "", true},
+		{"function URL without auth, opted in", "NONE", "true", false},
+		{"IAM auth", "AWS_IAM", "", false},
+		{"behind API Gateway", "", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("FUNCTION_URL_AUTH_TYPE", tt.authType)
+			t.Setenv("ALLOW_UNAUTHENTICATED_WRITES", tt.allow)
+			writesBlocked = false
+			initAuthGuard()
+			t.Cleanup(func() { writesBlocked = false })
+
+			fake := &fakeDynamo{
+				getItem: func(*dynamodb.GetItemInput) (*dynamodb.GetItemOutput, error) {
+					return &dynamodb.GetItemOutput{Item: carItem("a", "Toyota", "Corolla", 2020, 1)}, nil
+				},
+				putItem: func(*dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+					return &dynamodb.PutItemOutput{}, nil
+				},
+			}
+			app := newTestApp(t, fake)
+
+			resp, _ := app.handler(context.Background(), request("POST", "/", `{"id":"c","make":"Toyota","model":"Yaris","year":2021}`, nil))
+			if tt.wantBlocked {
+				if resp.StatusCode != http.StatusForbidden || errorCode(t, resp.Body) != "WRITES_DISABLED" {
+					t.Errorf("POST = %d %s, want 403 WRITES_DISABLED", resp.StatusCode, resp.Body)
+				}
+				if fake.called("PutItem cars") != 0 {
+					t.Error("blocked write reached the table")
+				}
+			} else if resp.StatusCode != http.StatusCreated {
+				t.Errorf("POST = %d %s, want 201", resp.StatusCode, resp.Body)
+			}
+
+			resp, _ = app.handler(context.Background(), request("GET", "/cars/a", "", nil))
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("GET = %d, reads should stay open", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestDedupeBatchPuts(t *testing.T) {
+	puts := []batchPut{
+		{index: 0, id: "b"},
+		{index: 1, id: "a"},
+		{index: 2, id: "c"},
+		{index: 3, id: "a"},
+		{index: 4, id: "b"},
+		{index: 5, id: "a"},
+	}
+	kept, dups := dedupeBatchPuts(puts)
+	if !slices.Equal(dups, []string{"a", "b"}) {
+		t.Errorf("dups = %v, want a and b in first-repeated order", dups)
+	}
+	var indexes []int
+	for _, p := range kept {
+		indexes = append(indexes, p.index)
+	}
+	// The last occurrence of each id survives, in payload order.
+	if !slices.Equal(indexes, []int{2, 4, 5}) {
+		t.Errorf("kept indexes = %v, want [2 4 5]", indexes)
+	}
+
+	unique := puts[:3]
+	if kept, dups := dedupeBatchPuts(unique); dups != nil || len(kept) != 3 {
+		t.Errorf("unique batch = %v, %v, want it unchanged", kept, dups)
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	p := backoffPolicy{base: 10 * time.Millisecond, cap: 100 * time.Millisecond, maxAttempts: 4}
+	for n, ceiling := range []time.Duration{10, 20, 40, 80, 100, 100} {
+		ceiling *= time.Millisecond
+		var lo, hi time.Duration = ceiling, 0
+		for range 1000 {
+			d := p.delay(n)
+			if d < 0 || d > ceiling {
+				t.Fatalf("delay(%d) = %v, want within [0, %v]", n, d, ceiling)
+			}
+			lo, hi = min(lo, d), max(hi, d)
+		}
+		// Full jitter spreads delays over the whole range.
+		if lo > ceiling/4 || hi < ceiling*3/4 {
+			t.Errorf("delay(%d) stayed within [%v, %v] of [0, %v]", n, lo, hi, ceiling)
+		}
+	}
+	if d := p.delay(64); d > p.cap {
+		t.Errorf("delay(64) = %v, want at most the cap", d)
+	}
+	if got, _ := p.BackoffDelay(1, nil); got > p.base {
+		t.Errorf("SDK retry 1 waited %v, want at most the base %v", got, p.base)
+	}
+}
+
+func TestRetryWithBackoffAttempts(t *testing.T) {
+	t.Setenv("DB_MAX_ATTEMPTS", "4")
+	t.Setenv("RETRY_BASE_MS", "1")
+	t.Setenv("RETRY_CAP_MS", "2")
+	errBoom := errors.New("boom")
+
+	tests := []struct {
+		name      string
+		doneAt    int
+		failAt    int
+		wantErr   error
+		wantCalls int
+	}{
+		{"done first time", 1, 0, nil, 1},
+		{"done on the third try", 3, 0, nil, 3},
+		{"never done", 0, 0, errRetriesExhausted, 4},
+		{"error stops retrying", 0, 2, errBoom, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryWithBackoff(context.Background(), func() (bool, error) {
+				calls++
+				if calls == tt.failAt {
+					return false, errBoom
+				}
+				return calls == tt.doneAt, nil
+			})
+			if !errors.Is(err, tt.wantErr) || calls != tt.wantCalls {
+				t.Errorf("err = %v after %d calls, want %v after %d", err, calls, tt.wantErr, tt.wantCalls)
+			}
+		})
+	}
+
+	t.Run("context ends while waiting", func(t *testing.T) {
+		t.Setenv("RETRY_BASE_MS", "1000")
+		t.Setenv("RETRY_CAP_MS", "1000")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		err := retryWithBackoff(ctx, func() (bool, error) { return false, nil })
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("err = %v, want context.DeadlineExceeded", err)
+		}
+	})
+}
+
+func TestULIDsAreMonotonic(t *testing.T) {
+	t.Setenv("ID_FORMAT", "ulid")
+	var ids []string
+	app := newTestApp(t, &fakeDynamo{putItem: func(in *dynamodb.PutItemInput) (*dynamodb.PutItemOutput, error) {
+		ids = append(ids, stringAttr(in.Item, "ID"))
+		return &dynamodb.PutItemOutput{}, nil
+	}})
+	// Two creates, typically within the same millisecond.
+	for range 2 {
+		resp, _ := app.handler(context.Background(), request("POST", "/", `{"make":"Toyota","model":"Corolla","year":2020}`, nil))
+		if resp.StatusCode != http.StatusCreated {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+	}
+	if len(ids) != 2 || len(ids[0]) != 26 || ids[0] >= ids[1] {
+		t.Errorf("ids = %q, want two increasing 26-character ULIDs", ids)
+	}
+
+	prev := newCarID()
+	for range 1000 {
+		id := newCarID()
+		if id <= prev {
+			t.Fatalf("%s came after %s", id, prev)
+		}
+		prev = id
+	}
+
+	t.Setenv("ID_FORMAT", "")
+	if id := newCarID(); len(id) != 36 || id[14] != '4' {
+		t.Errorf("default id %q isn't a UUIDv4", id)
+	}
+}
+
+func TestBatchPostDeadLetters(t *testing.T) {
+	const body = `[
+		{"id":"a","make":"Toyota","model":"Corolla","year":2020},
+		{"id":"poison","make":"Opel","model":"Astra","year":2018},
+		{"id":"b","make":"Fiat","model":"Panda","year":2017}
+	]`
+	var written []string
+	fake := &fakeDynamo{
+		batchGetItem: existingKeys(),
+		// The poison row is never processed, however often it is retried.
+		batchWriteItem: func(in *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+			var unprocessed []types.WriteRequest
+			for _, r := range in.RequestItems["cars"] {
+				if id := stringAttr(r.PutRequest.Item, "ID"); id == "poison" {
+					unprocessed = append(unprocessed, r)
+				} else {
+					written = append(written, id)
+				}
+			}
+			out := &dynamodb.BatchWriteItemOutput{}
+			if len(unprocessed) > 0 {
+				out.UnprocessedItems = map[string][]types.WriteRequest{"cars": unprocessed}
+			}
+			return out, nil
+		},
+	}
+	app := newTestApp(t, fake)
+	t.Setenv("BATCH_DEAD_LETTER", "true")
+	t.Setenv("EXPORT_BUCKET", "exports-bucket")
+	objects := stubS3(t, "exports-bucket")
+
+	resp, _ := app.handler(context.Background(), request("POST", "/batch", body, nil))
+	if resp.StatusCode != http.StatusMultiStatus {
+		t.Fatalf("status = %d, want 207: %s", resp.StatusCode, resp.Body)
+	}
+	var summary batchSummary
+	if err := json.Unmarshal([]byte(resp.Body), &summary); err != nil {
+		t.Fatal(err)
+	}
+	slices.Sort(written)
+	if summary.Written != 2 || !slices.Equal(written, []string{"a", "b"}) {
+		t.Errorf("written = %d %v, want a and b", summary.Written, written)
+	}
+	if len(summary.Failed) != 1 || summary.Failed[0].ID != "poison" {
+		t.Fatalf("failed = %+v, want only poison", summary.Failed)
+	}
+	if summary.DeadLettered != 1 || !strings.HasPrefix(summary.DeadLetterKey, "dead-letter/") {
+		t.Fatalf("dead-lettered %d to %q", summary.DeadLettered, summary.DeadLetterKey)
+	}
+
+	var row deadLetterRow
+	if err := json.Unmarshal([]byte(objects[summary.DeadLetterKey]), &row); err != nil {
+		t.Fatalf("dead-letter object %q: %v", objects[summary.DeadLetterKey], err)
+	}
+	var car Car
+	if err := json.Unmarshal(row.Row, &car); err != nil || row.Index != 1 || car.ID != "poison" || row.Reason != summary.Failed[0].Reason {
+		t.Errorf("dead-letter row = %+v, want the original poison row and its reason", row)
+	}
+}
+
+func TestListTimeBudget(t *testing.T) {
+	var cars []map[string]types.AttributeValue
+	for i := range 10 {
+		cars = append(cars, carItem("car"+strconv.Itoa(i), "Toyota", "Corolla", 2020, 1))
+	}
+	// scanFrom returns one car per call, as a selective filter would, taking
+	// delay to do so.
+	scanFrom := func(delay time.Duration) func(*dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+		return func(in *dynamodb.ScanInput) (*dynamodb.ScanOutput, error) {
+			time.Sleep(delay)
+			next := 0
+			if in.ExclusiveStartKey != nil {
+				next = slices.IndexFunc(cars, func(c map[string]types.AttributeValue) bool {
+					return stringAttr(c, "ID") == stringAttr(in.ExclusiveStartKey, "ID")
+				}) + 1
+			}
+			out := &dynamodb.ScanOutput{Items: cars[next : next+1]}
+			if next+1 < len(cars) {
+				out.LastEvaluatedKey = map[string]types.AttributeValue{"ID": cars[next]["ID"]}
+			}
+			return out, nil
+		}
+	}
+	list := func(t *testing.T, app *App, path string) carPage {
+		t.Helper()
+		resp, _ := app.handler(context.Background(), request("GET", path, "", nil))
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d: %s", resp.StatusCode, resp.Body)
+		}
+		var page carPage
+		if err := json.Unmarshal([]byte(resp.Body), &page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+
+	t.Run("slow reads are cut short with a token", func(t *testing.T) {
+		fake := &fakeDynamo{scan: scanFrom(20 * time.Millisecond)}
+		app := newTestApp(t, fake)
+		t.Setenv("LIST_TIME_BUDGET_MS", "30")
+
+		page := list(t, app, "/?limit=5")
+		if !page.Partial || page.NextToken == "" || len(page.Items) == 0 || len(page.Items) >= 5 {
+			t.Fatalf("page = %d items, partial %v, token %q; want a partial page with a token", len(page.Items), page.Partial, page.NextToken)
+		}
+		reads := fake.called("Scan cars")
+		if reads != len(page.Items) {
+			t.Errorf("%d reads for %d items, want reading to stop at the budget", reads, len(page.Items))
+		}
+
+		last := page.Items[len(page.Items)-1].ID
+		next := list(t, app, "/?limit=5&nextToken="+page.NextToken)
+		if want := "car" + strconv.Itoa(len(page.Items)); len(next.Items) == 0 || next.Items[0].ID != want {
+			t.Errorf("after %s the next page starts at %v, want %s", last, next.Items, want)
+		}
+	})
+
+	t.Run("fast reads fill the page", func(t *testing.T) {
+		app := newTestApp(t, &fakeDynamo{scan: scanFrom(0)})
+		t.Setenv("LIST_TIME_BUDGET_MS", "10000")
+
+		page := list(t, app, "/?limit=5")
+		if page.Partial || len(page.Items) != 5 || page.NextToken == "" {
+			t.Errorf("page = %d items, partial %v, token %q; want 5 items and a token", len(page.Items), page.Partial, page.NextToken)
+		}
+	})
+
+	t.Run("no budget reads once", func(t *testing.T) {
+		fake := &fakeDynamo{scan: scanFrom(0)}
+		app := newTestApp(t, fake)
+		t.Setenv("LIST_TIME_BUDGET_MS", "")
+
+		page := list(t, app, "/?limit=5")
+		if page.Partial || len(page.Items) != 1 || fake.called("Scan cars") != 1 {
+			t.Errorf("page = %d items, partial %v after %d reads; want one read", len(page.Items), page.Partial, fake.called("Scan cars"))
+		}
+	})
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+)
+
+// Logs are JSON lines on stdout so CloudWatch Logs Insights can filter on
+// their fields. handler puts a logger carrying the API Gateway request ID in
+// the context; code that has a ctx logs through loggerFrom so every line of
+// a request can be correlated, the rest uses slog's default logger.
+//
+// LOG_LEVEL (debug, info, warn or error) sets the minimum level; it defaults
+// to info. At debug, request bodies are logged too.
+func initLogging() {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil {
+		level = slog.LevelInfo
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+}
+
+type loggerKey struct{}
+
+func withLogger(ctx context.Context, l *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, l)
+}
+
+// loggerFrom returns the request-scoped logger, or the default logger when
+// ctx has none.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if l, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return l
+	}
+	return slog.Default()
+}
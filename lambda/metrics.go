@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// Request metrics for GET /metrics in the Prometheus text exposition format.
+//
+// The values are accumulated in memory per Lambda container, so each scrape
+// only sees the requests served by whichever container answered it, and the
+// counters reset whenever that container is recycled. Aggregate across
+// scrapes with rate()/increase() rather than reading absolute values.
+var latencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type latencyHistogram struct {
+	buckets []uint64 // cumulative counts, one per latencyBuckets entry
+	sum     float64
+	count   uint64
+}
+
+var metrics = struct {
+	sync.Mutex
+	requests map[[2]string]uint64 // method, status
+	errors   map[string]uint64    // method, 5xx only
+	latency  map[string]*latencyHistogram
+}{
+	requests: map[[2]string]uint64{},
+	errors:   map[string]uint64{},
+	latency:  map[string]*latencyHistogram{},
+}
+
+func recordRequest(method string, status int, elapsed time.Duration) {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	metrics.requests[[2]string{method, fmt.Sprint(status)}]++
+	if status >= 500 {
+		metrics.errors[method]++
+	}
+	h := metrics.latency[method]
+	if h == nil {
+		h = &latencyHistogram{buckets: make([]uint64, len(latencyBuckets))}
+		metrics.latency[method] = h
+	}
+	seconds := elapsed.Seconds()
+	for i, le := range latencyBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// handleMetrics serves the metrics to callers presenting ADMIN_TOKEN as a
+// bearer token. Without ADMIN_TOKEN the endpoint is disabled.
+func handleMetrics(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	if resp, ok := requireAdmin(ctx, req); !ok {
+		return resp, nil
+	}
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       renderMetrics(),
+		Headers:    map[string]string{"Content-Type": "text/plain; version=0.0.4"},
+	}, nil
+}
+
+// requireAdmin checks the request's bearer token against ADMIN_TOKEN. When
+// ADMIN_TOKEN isn't set admin features are disabled and the caller gets 404.
+func requireAdmin(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, bool) {
+	token := secret(ctx, "ADMIN_TOKEN")
+	if token == "" {
+		return errorResponse(http.StatusNotFound, "NOT_FOUND", "not found"), false
+	}
+	got := strings.TrimPrefix(req.Headers["authorization"], "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+		return errorResponse(http.StatusUnauthorized, "UNAUTHORIZED", "unauthorized"), false
+	}
+	return events.APIGatewayV2HTTPResponse{}, true
+}
+
+func renderMetrics() string {
+	metrics.Lock()
+	defer metrics.Unlock()
+
+	var b strings.Builder
+
+	b.WriteString("# HELP cars_api_requests_total Requests handled by this container.\n")
+	b.WriteString("# TYPE cars_api_requests_total counter\n")
+	keys := make([][2]string, 0, len(metrics.requests))
+	for k := range metrics.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i][0] != keys[j][0] {
+			return keys[i][0] < keys[j][0]
+		}
+		return keys[i][1] < keys[j][1]
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "cars_api_requests_total{method=%q,status=%q} %d\n", k[0], k[1], metrics.requests[k])
+	}
+
+	b.WriteString("# HELP cars_api_errors_total Requests that ended in a 5xx response.\n")
+	b.WriteString("# TYPE cars_api_errors_total counter\n")
+	for _, method := range sortedKeys(metrics.errors) {
+		fmt.Fprintf(&b, "cars_api_errors_total{method=%q} %d\n", method, metrics.errors[method])
+	}
+
+	b.WriteString("# HELP cars_api_request_duration_seconds Request latency.\n")
+	b.WriteString("# TYPE cars_api_request_duration_seconds histogram\n")
+	for _, method := range sortedKeys(metrics.latency) {
+		h := metrics.latency[method]
+		for i, le := range latencyBuckets {
+			fmt.Fprintf(&b, "cars_api_request_duration_seconds_bucket{method=%q,le=\"%g\"} %d\n", method, le, h.buckets[i])
+		}
+		fmt.Fprintf(&b, "cars_api_request_duration_seconds_bucket{method=%q,le=\"+Inf\"} %d\n", method, h.count)
+		fmt.Fprintf(&b, "cars_api_request_duration_seconds_sum{method=%q} %g\n", method, h.sum)
+		fmt.Fprintf(&b, "cars_api_request_duration_seconds_count{method=%q} %d\n", method, h.count)
+	}
+
+	return b.String()
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Page sizes for list requests: defaultPageSize applies when no limit query
+// parameter is given, and larger limits are clamped to maxPageSize.
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// carPage is the response envelope for list requests. NextToken is omitted on
+// the last page; otherwise passing it back as ?nextToken= fetches the next one.
+type carPage struct {
+	Items     []Car  `json:"items"`
+	NextToken string `json:"nextToken,omitempty"`
+	// Partial is set when the page was cut short by LIST_TIME_BUDGET_MS.
+	Partial bool `json:"partial,omitempty"`
+}
+
+// parseLimit validates the limit query parameter, applying defaultPageSize
+// when it is absent and clamping it to maxPageSize.
+func parseLimit(raw string) (int32, error) {
+	if raw == "" {
+		return defaultPageSize, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 1 {
+		return 0, errors.New("limit must be a positive integer")
+	}
+	return int32(min(n, maxPageSize)), nil
+}
+
+// encodeNextToken turns a LastEvaluatedKey into an opaque token for clients.
+func encodeNextToken(key map[string]types.AttributeValue) (string, error) {
+	if len(key) == 0 {
+		return "", nil
+	}
+	var plain map[string]interface{}
+	if err := attributevalue.UnmarshalMap(key, &plain); err != nil {
+		return "", err
+	}
+	b, err := json.Marshal(plain)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// decodeNextToken is the inverse of encodeNextToken, producing an
+// ExclusiveStartKey.
+func decodeNextToken(token string) (map[string]types.AttributeValue, error) {
+	if token == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	var plain map[string]interface{}
+	if err := json.Unmarshal(b, &plain); err != nil {
+		return nil, err
+	}
+	if len(plain) == 0 {
+		return nil, errors.New("empty token")
+	}
+	return attributevalue.MarshalMap(plain)
+}
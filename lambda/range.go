@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// defaultMaxRangeEnd is the first item index a Range may not reach when
+// MAX_RANGE_END is not set. Serving a range means reading every matching item
+// before it, so this bounds the read a single request can cause.
+const defaultMaxRangeEnd = 1000
+
+// itemsRange is a parsed `Range: items=first-last` header; both ends are
+// zero-based and inclusive.
+type itemsRange struct {
+	first, last int
+}
+
+// parseItemsRange parses a Range header in the items unit. Anything that
+// isn't a well-formed single items range is reported as !ok so the request
+// is served as a normal list, as RFC 9110 requires for ranges a server
+// doesn't understand.
+func parseItemsRange(header string) (itemsRange, bool) {
+	spec, ok := strings.CutPrefix(strings.TrimSpace(header), "items=")
+	if !ok {
+		return itemsRange{}, false
+	}
+	a, b, ok := strings.Cut(spec, "-")
+	if !ok {
+		return itemsRange{}, false
+	}
+	first, err1 := strconv.Atoi(strings.TrimSpace(a))
+	last, err2 := strconv.Atoi(strings.TrimSpace(b))
+	if err1 != nil || err2 != nil || first < 0 || last < first {
+		return itemsRange{}, false
+	}
+	return itemsRange{first: first, last: last}, true
+}
+
+// listRange answers a list request carrying an items Range with 206 and the
+// requested slice. DynamoDB can't skip ahead, so it pages through the
+// matching items from the start until it reaches r.last; ranges deep into a
+// large result set cost as much as reading everything before them. A range
+// wider than maxPageSize or reaching MAX_RANGE_END is shortened, which
+// Content-Range reflects.
+//
+// A range starting past the last matching item gets 416 with the total, one
+// starting at or beyond MAX_RANGE_END gets 416 without reading anything.
+func (a *App) listRange(ctx context.Context, table, carMake string, f listFilter, r itemsRange) (events.APIGatewayV2HTTPResponse, error) {
+	end := maxRangeEnd()
+	if r.first >= end {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Headers: map[string]string{
+				"Content-Range": "items */*",
+			},
+		}, nil
+	}
+	r.last = min(r.last, r.first+maxPageSize-1, end-1)
+
+	var cars []Car
+	var startKey map[string]types.AttributeValue
+	exhausted := false
+	for len(cars) <= r.last {
+		items, lastKey, err := a.listItems(ctx, table, carMake, f, maxPageSize, startKey)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		cars = append(cars, decodeCars(items)...)
+		if len(lastKey) == 0 {
+			exhausted = true
+			break
+		}
+		startKey = lastKey
+	}
+
+	if r.first >= len(cars) {
+		return events.APIGatewayV2HTTPResponse{
+			StatusCode: http.StatusRequestedRangeNotSatisfiable,
+			Headers: map[string]string{
+				"Content-Range": fmt.Sprintf("items */%d", len(cars)),
+			},
+		}, nil
+	}
+
+	slice := cars[r.first:min(r.last+1, len(cars))]
+	total := "*"
+	if exhausted {
+		total = strconv.Itoa(len(cars))
+	}
+	body, _ := json.Marshal(carPage{Items: slice})
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusPartialContent,
+		Body:       string(body),
+		Headers: map[string]string{
+			"Content-Type":  "application/json",
+			"Content-Range": fmt.Sprintf("items %d-%d/%s", r.first, r.first+len(slice)-1, total),
+		},
+	}, nil
+}
+
+// maxRangeEnd reads MAX_RANGE_END, falling back to defaultMaxRangeEnd when
+// it is unset or invalid.
+func maxRangeEnd() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_RANGE_END")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxRangeEnd
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// withRecovery turns a panic in next into a 500 with the request ID, logged
+// with its stack trace, instead of a failed invocation that API Gateway
+// reports as an opaque 502. Panics in goroutines next starts can't be
+// recovered here and still crash the container.
+func withRecovery(next func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error)) func(context.Context, events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	return func(ctx context.Context, req events.APIGatewayV2HTTPRequest) (resp events.APIGatewayV2HTTPResponse, err error) {
+		defer func() {
+			r := recover()
+			if r == nil {
+				return
+			}
+			id := req.RequestContext.RequestID
+			logger := slog.Default().With("requestId", id, "stack", string(debug.Stack()))
+			ctx := withLogger(withRequestID(ctx, id), logger)
+			resp = withCORS(handleInternalError(ctx, fmt.Errorf("panic: %v", r)), req.Headers["origin"])
+			err = nil
+		}()
+		return next(ctx, req)
+	}
+}
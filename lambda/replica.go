@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Optional best-effort mirroring of writes to a table in another region,
+// enabled by setting both REPLICA_REGION and REPLICA_TABLE.
+//
+// This is a stopgap for disaster recovery, not a substitute for DynamoDB
+// Global Tables: mirror writes run in the background after the primary write
+// succeeds, failures are only logged and never retried, and nothing
+// reconciles the two tables if they drift apart.
+var (
+	replicaDB    DynamoAPI
+	replicaTable string
+	// replicaWrites tracks in-flight mirror writes. The handler waits on it
+	// before returning because Lambda freezes the container, and any
+	// goroutines still running, as soon as the response is sent.
+	replicaWrites sync.WaitGroup
+)
+
+const replicaWriteTimeout = 5 * time.Second
+
+func initReplica() {
+	region := os.Getenv("REPLICA_REGION")
+	replicaTable = os.Getenv("REPLICA_TABLE")
+	if region == "" || replicaTable == "" {
+		return
+	}
+	cfg, err := config.LoadDefaultConfig(context.Background(), config.WithRegion(region))
+	if err != nil {
+		panic(fmt.Sprintf("unable to load AWS SDK config for replica region %s, %v", region, err))
+	}
+	replicaDB = dynamodb.NewFromConfig(cfg)
+}
+
+// mirrorPut copies an item to the replica table in the background.
+func mirrorPut(item map[string]types.AttributeValue) {
+	if replicaDB == nil {
+		return
+	}
+	replicaWrites.Add(1)
+	go func() {
+		defer replicaWrites.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), replicaWriteTimeout)
+		defer cancel()
+		_, err := replicaDB.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName: &replicaTable,
+			Item:      item,
+		})
+		if err != nil {
+			slog.Error("replica put failed", "error", err)
+		}
+	}()
+}
+
+// mirrorDelete removes keys from the replica table in the background.
+func mirrorDelete(keys ...map[string]types.AttributeValue) {
+	if replicaDB == nil || len(keys) == 0 {
+		return
+	}
+	replicaWrites.Add(1)
+	go func() {
+		defer replicaWrites.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), replicaWriteTimeout)
+		defer cancel()
+		for _, key := range keys {
+			_, err := replicaDB.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+				TableName: &replicaTable,
+				Key:       key,
+			})
+			if err != nil {
+				slog.Error("replica delete failed", "error", err)
+			}
+		}
+	}()
+}
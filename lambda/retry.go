@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/aws/retry"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/aws/smithy-go"
+)
+
+// Every retry in the function, whether the SDK retrying a throttled or
+// failed call or a batch loop resubmitting unprocessed items, waits with the
+// same full-jitter exponential backoff: a uniformly random delay between 0
+// and min(cap, base * 2^retry). The randomness spreads out concurrent
+// containers that hit the same throttle instead of having them retry in
+// lockstep.
+//
+// DB_MAX_ATTEMPTS bounds the total number of tries, RETRY_BASE_MS and
+// RETRY_CAP_MS the delay.
+const (
+	defaultDBMaxAttempts = 4
+	defaultRetryBase     = 50 * time.Millisecond
+	defaultRetryCap      = 2 * time.Second
+)
+
+// errRetriesExhausted is returned by retryWithBackoff when the operation
+// still wasn't done after the last attempt.
+var errRetriesExhausted = errors.New("retries exhausted")
+
+type backoffPolicy struct {
+	base, cap   time.Duration
+	maxAttempts int
+}
+
+func currentBackoffPolicy() backoffPolicy {
+	return backoffPolicy{
+		base:        envMillis("RETRY_BASE_MS", defaultRetryBase),
+		cap:         envMillis("RETRY_CAP_MS", defaultRetryCap),
+		maxAttempts: dbMaxAttempts(),
+	}
+}
+
+// delay returns the full-jitter wait before retry number n, counting from 0.
+func (p backoffPolicy) delay(n int) time.Duration {
+	ceiling := p.cap
+	if n < 32 {
+		ceiling = min(p.cap, p.base<<n)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	return rand.N(ceiling + 1)
+}
+
+// BackoffDelay lets the policy stand in for the SDK retryer's backoff. The
+// SDK numbers its retries from 1.
+func (p backoffPolicy) BackoffDelay(attempt int, _ error) (time.Duration, error) {
+	return p.delay(attempt - 1), nil
+}
+
+// retryWithBackoff calls op until it reports done or fails, sleeping between
+// calls per the current backoff policy. It gives up with errRetriesExhausted
+// after the policy's maximum number of attempts, or with the context's error
+// if ctx ends while waiting.
+func retryWithBackoff(ctx context.Context, op func() (done bool, err error)) error {
+	p := currentBackoffPolicy()
+	for attempt := 0; ; attempt++ {
+		done, err := op()
+		if err != nil || done {
+			return err
+		}
+		if attempt+1 >= p.maxAttempts {
+			return errRetriesExhausted
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(p.delay(attempt)):
+		}
+	}
+}
+
+// newDBRetryer builds the retryer used by the DynamoDB client. On top of the
+// SDK's standard retryable errors it explicitly retries
+// *types.InternalServerError, so transient DynamoDB 500s are absorbed before
+// they ever reach a handler.
+func newDBRetryer() aws.Retryer {
+	p := currentBackoffPolicy()
+	return retry.NewStandard(func(o *retry.StandardOptions) {
+		o.MaxAttempts = p.maxAttempts
+		o.MaxBackoff = p.cap
+		o.Backoff = p
+		o.Retryables = append(o.Retryables, retry.IsErrorRetryableFunc(func(err error) aws.Ternary {
+			var ise *types.InternalServerError
+			if errors.As(err, &ise) {
+				return aws.TrueTernary
+			}
+			return aws.UnknownTernary
+		}))
+	})
+}
+
+// dbMaxAttempts reads DB_MAX_ATTEMPTS, falling back to defaultDBMaxAttempts
+// when it is unset or invalid.
+func dbMaxAttempts() int {
+	if n, err := strconv.Atoi(os.Getenv("DB_MAX_ATTEMPTS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultDBMaxAttempts
+}
+
+// envMillis reads a non-negative duration in milliseconds from the named
+// variable, falling back to def when it is unset or invalid.
+func envMillis(name string, def time.Duration) time.Duration {
+	if n, err := strconv.Atoi(os.Getenv(name)); err == nil && n >= 0 {
+		return time.Duration(n) * time.Millisecond
+	}
+	return def
+}
+
+// dbErrorResponse turns a failed call into a response. A server-side error
+// from DynamoDB or another AWS service that survived all retries is
+// reported as 503 DEPENDENCY_UNAVAILABLE naming the service, so clients know
+// to try again later and dashboards can tell causes apart; a call that ran
+// past its deadline is a 504; anything else is a plain 500.
+func dbErrorResponse(ctx context.Context, err error) events.APIGatewayV2HTTPResponse {
+	if errors.Is(err, context.DeadlineExceeded) {
+		loggerFrom(ctx).Warn("database call timed out", "error", err)
+		return errorResponse(http.StatusGatewayTimeout, "DB_TIMEOUT", "database did not respond in time, please retry")
+	}
+	var ise *types.InternalServerError
+	var respErr *awshttp.ResponseError
+	if errors.As(err, &ise) || (errors.As(err, &respErr) && respErr.HTTPStatusCode() >= 500) {
+		dependency := failedDependency(err)
+		loggerFrom(ctx).Warn("dependency unavailable", "dependency", dependency, "error", err)
+		return errorEnvelopeResponse(http.StatusServiceUnavailable, apiError{
+			Code:       "DEPENDENCY_UNAVAILABLE",
+			Message:    dependency + " temporarily unavailable, please retry",
+			Dependency: dependency,
+		})
+	}
+	return handleInternalError(ctx, err)
+}
+
+// failedDependency names the AWS service a failed call went to, lowercased
+// ("dynamodb", "s3"), defaulting to dynamodb for errors the SDK didn't wrap.
+func failedDependency(err error) string {
+	var opErr *smithy.OperationError
+	if errors.As(err, &opErr) {
+		return strings.ToLower(opErr.Service())
+	}
+	return "dynamodb"
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+)
+
+// Secrets (ADMIN_TOKEN, RESPONSE_SIGNING_SECRET) can be kept in Secrets
+// Manager instead of plain environment variables: SECRETS_ARN names a
+// secret whose value is a JSON object of those names to values. It is
+// cached per container and re-read once SECRETS_REFRESH_SECONDS have
+// passed, so a rotation takes effect without a redeploy. A failed refresh
+// keeps serving the last values it got.
+//
+// Without SECRETS_ARN, or for a name the secret doesn't contain, secret
+// falls back to the environment variable of the same name.
+const defaultSecretsRefresh = 5 * time.Minute
+
+var secretsClient *secretsmanager.Client
+
+var secretCache = struct {
+	sync.Mutex
+	values   map[string]string
+	loadedAt time.Time
+}{}
+
+func initSecrets(cfg aws.Config) {
+	if os.Getenv("SECRETS_ARN") != "" {
+		secretsClient = secretsmanager.NewFromConfig(cfg)
+	}
+}
+
+// secret returns the named secret value, or "" when it isn't set anywhere.
+func secret(ctx context.Context, name string) string {
+	arn := os.Getenv("SECRETS_ARN")
+	if arn == "" || secretsClient == nil {
+		return os.Getenv(name)
+	}
+
+	secretCache.Lock()
+	defer secretCache.Unlock()
+	if secretCache.values == nil || time.Since(secretCache.loadedAt) >= secretsRefresh() {
+		if values, err := loadSecrets(ctx, arn); err != nil {
+			loggerFrom(ctx).Error("loading secrets failed", "error", err)
+		} else {
+			secretCache.values = values
+		}
+		// Also on failure, so an outage isn't retried on every request.
+		secretCache.loadedAt = time.Now()
+	}
+	if v, ok := secretCache.values[name]; ok {
+		return v
+	}
+	return os.Getenv(name)
+}
+
+func loadSecrets(ctx context.Context, arn string) (map[string]string, error) {
+	out, err := secretsClient.GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{SecretId: &arn})
+	if err != nil {
+		return nil, err
+	}
+	var values map[string]string
+	if err := json.Unmarshal([]byte(aws.ToString(out.SecretString)), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+// secretsRefresh reads SECRETS_REFRESH_SECONDS, falling back to
+// defaultSecretsRefresh when it is unset or invalid.
+func secretsRefresh() time.Duration {
+	if n, err := strconv.Atoi(os.Getenv("SECRETS_REFRESH_SECONDS")); err == nil && n > 0 {
+		return time.Duration(n) * time.Second
+	}
+	return defaultSecretsRefresh
+}
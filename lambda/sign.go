@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// signResponse adds an X-Body-Signature header when RESPONSE_SIGNING_SECRET is
+// set, so partners can detect responses altered by an intermediary.
+//
+// The signature is "sha256=" followed by the lowercase hex HMAC-SHA256 of the
+// response body, keyed with the shared secret. The body is signed exactly as
+// the handler produced it: no whitespace or key-order normalization, and
+// before compressResponse gzips it or any base64 transfer encoding, so
+// clients must verify against the raw bytes they received after undoing
+// Content-Encoding. Empty bodies are signed too.
+func signResponse(ctx context.Context, resp events.APIGatewayV2HTTPResponse) events.APIGatewayV2HTTPResponse {
+	key := secret(ctx, "RESPONSE_SIGNING_SECRET")
+	if key == "" {
+		return resp
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write([]byte(resp.Body))
+	if resp.Headers == nil {
+		resp.Headers = map[string]string{}
+	}
+	resp.Headers["X-Body-Signature"] = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	return resp
+}
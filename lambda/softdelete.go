@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// With SOFT_DELETE=true, deletes keep the item and mark it with Deleted and
+// DeletedAt instead, leaving an audit trail that can be recovered by hand.
+// Reads hide marked items unless ?includeDeleted=true is passed, whatever
+// the current mode, so turning SOFT_DELETE off again doesn't resurface them.
+// includeDeleted is for admins: it requires the ADMIN_TOKEN bearer token
+// like /metrics, and the cars it adds carry "deleted": true.
+// Patches and re-creates treat them as gone and existing respectively.
+func softDeleteEnabled() bool {
+	return os.Getenv("SOFT_DELETE") == "true"
+}
+
+// includeDeleted reports whether the request asked to see soft-deleted cars;
+// route checks the caller is an admin before any handler honours it.
+func includeDeleted(req events.APIGatewayV2HTTPRequest) bool {
+	return req.QueryStringParameters["includeDeleted"] == "true"
+}
+
+// isSoftDeleted reports whether a raw item carries the Deleted mark.
+func isSoftDeleted(item map[string]types.AttributeValue) bool {
+	deleted, ok := item["Deleted"].(*types.AttributeValueMemberBOOL)
+	return ok && deleted.Value
+}
+
+// softDeleteByID marks a single car deleted, answering 404 when it doesn't
+// exist or is already marked. On success it returns the updated item.
+func (a *App) softDeleteByID(ctx context.Context, table, id string) (map[string]types.AttributeValue, *events.APIGatewayV2HTTPResponse) {
+	out, err := a.softDelete(ctx, table, map[string]types.AttributeValue{
+		"ID": &types.AttributeValueMemberS{Value: id},
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		resp := errorResponse(http.StatusNotFound, "NOT_FOUND", "item not found")
+		return nil, &resp
+	}
+	if err != nil {
+		resp := dbErrorResponse(ctx, err)
+		return nil, &resp
+	}
+	return out, nil
+}
+
+// softDeleteKeys marks every key deleted one at a time, since
+// BatchWriteItem can't update. Keys already marked or gone are skipped.
+func (a *App) softDeleteKeys(ctx context.Context, table string, keys []map[string]types.AttributeValue) error {
+	for _, key := range keys {
+		attrs, err := a.softDelete(ctx, table, key)
+		var ccf *types.ConditionalCheckFailedException
+		if errors.As(err, &ccf) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		mirrorPut(attrs)
+	}
+	return nil
+}
+
+func (a *App) softDelete(ctx context.Context, table string, key map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+	now := nowTimestamp()
+	out, err := a.db.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:           &table,
+		Key:                 key,
+		UpdateExpression:    aws.String("SET #deleted = :true, #deletedAt = :now, #updatedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(#id) AND attribute_not_exists(#deleted)"),
+		ExpressionAttributeNames: map[string]string{
+			"#id":        "ID",
+			"#deleted":   "Deleted",
+			"#deletedAt": "DeletedAt",
+			"#updatedAt": "UpdatedAt",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":true": &types.AttributeValueMemberBOOL{Value: true},
+			":now":  &types.AttributeValueMemberS{Value: now},
+		},
+		ReturnValues: types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Attributes, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"cmp"
+	"errors"
+	"slices"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// listSort is a parsed ?sort= and ?order= pair. A zero listSort leaves the
+// page in DynamoDB's order.
+//
+// Scans and queries come back in key order, not in any order a client would
+// ask for, so sorting is done in memory on the page being returned. It
+// doesn't carry across pages: each page is sorted on its own, and following
+// nextToken doesn't continue a global ordering. Range requests aren't
+// sorted.
+type listSort struct {
+	field string
+	desc  bool
+}
+
+// sortAttributes maps the names accepted by ?sort= to the attributes they
+// compare. Year compares as a number, the rest as strings.
+var sortAttributes = map[string]string{
+	"id":    "ID",
+	"make":  "Make",
+	"model": "Model",
+	"year":  "Year",
+}
+
+func parseSort(sort, order string) (listSort, error) {
+	if sort == "" {
+		if order != "" {
+			return listSort{}, errors.New("order requires sort")
+		}
+		return listSort{}, nil
+	}
+	if _, ok := sortAttributes[sort]; !ok {
+		return listSort{}, errors.New("sort must be one of id, make, model, year")
+	}
+	switch order {
+	case "", "asc":
+		return listSort{field: sort}, nil
+	case "desc":
+		return listSort{field: sort, desc: true}, nil
+	default:
+		return listSort{}, errors.New("order must be asc or desc")
+	}
+}
+
+// apply sorts items in place. Ties are broken by id so the order is stable
+// between requests.
+func (s listSort) apply(items []map[string]types.AttributeValue) {
+	if s.field == "" {
+		return
+	}
+	attr := sortAttributes[s.field]
+	slices.SortStableFunc(items, func(a, b map[string]types.AttributeValue) int {
+		var c int
+		if attr == "Year" {
+			c = cmp.Compare(yearOf(a), yearOf(b))
+		} else {
+			c = cmp.Compare(stringAttr(a, attr), stringAttr(b, attr))
+		}
+		if c == 0 {
+			c = cmp.Compare(stringAttr(a, "ID"), stringAttr(b, "ID"))
+		}
+		if s.desc {
+			return -c
+		}
+		return c
+	})
+}
+
+// yearOf returns an item's Year, or 0 when it is missing or malformed.
+func yearOf(item map[string]types.AttributeValue) int {
+	year, _ := strconv.Atoi(numberAttr(item, "Year"))
+	return year
+}
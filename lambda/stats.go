@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// The by-year stats need a full table scan, so the result is kept in memory
+// for a short while. The cache lives as long as the Lambda container does.
+const defaultStatsCacheTTL = 60 * time.Second
+
+var statsCache struct {
+	sync.Mutex
+	byYear   map[string]int
+	loadedAt time.Time
+}
+
+func (a *App) handleStatsByYear(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	statsCache.Lock()
+	defer statsCache.Unlock()
+
+	if statsCache.byYear == nil || time.Since(statsCache.loadedAt) > statsCacheTTL() {
+		counts, err := a.countByYear(ctx, TableNameEnv)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		statsCache.byYear = counts
+		statsCache.loadedAt = time.Now()
+	}
+
+	body, _ := json.Marshal(statsCache.byYear)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json"},
+	}, nil
+}
+
+// countByYear scans only the Year attribute of every item and tallies them.
+// Items without a numeric Year, drafts and soft-deleted items are skipped.
+func (a *App) countByYear(ctx context.Context, table string) (map[string]int, error) {
+	counts := map[string]int{}
+	input := &dynamodb.ScanInput{
+		TableName:            &table,
+		FilterExpression:     aws.String("attribute_not_exists(#deleted) AND attribute_not_exists(#status)"),
+		ProjectionExpression: aws.String("#y"),
+		// YEAR is a DynamoDB reserved word.
+		ExpressionAttributeNames: map[string]string{"#y": "Year", "#deleted": "Deleted", "#status": draftStatusAttribute},
+	}
+	for {
+		out, err := a.db.Scan(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		for _, item := range out.Items {
+			if y, ok := item["Year"].(*types.AttributeValueMemberN); ok {
+				counts[y.Value]++
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return counts, nil
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// statsCacheTTL reads STATS_CACHE_TTL_SECONDS, falling back to
+// defaultStatsCacheTTL when it is unset or invalid.
+func statsCacheTTL() time.Duration {
+	if s, err := strconv.Atoi(os.Getenv("STATS_CACHE_TTL_SECONDS")); err == nil && s >= 0 {
+		return time.Duration(s) * time.Second
+	}
+	return defaultStatsCacheTTL
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+)
+
+// handleStream serves GET /stream as Server-Sent Events: one `data:` event
+// per car in scan order, then a final `event: end`.
+//
+// Behind API Gateway the Lambda response is buffered, so the client only
+// receives the events once the whole scan has finished; the endpoint gives
+// a UI the SSE framing but not progressive rendering, and the whole body has
+// to fit in the 6 MB response limit. The optional streaming function URL
+// (see streamingHandler) serves the same events incrementally.
+//
+// The usual list filters apply, so drafts and soft-deleted cars are left out
+// unless an admin asks for includeDeleted=true (route checks the token).
+func (a *App) handleStream(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	var body strings.Builder
+	filter, err := buildListFilter(req.QueryStringParameters)
+	if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error()), nil
+	}
+	input := &dynamodb.ScanInput{
+		TableName:                 &TableNameEnv,
+		FilterExpression:          filter.expression(),
+		ExpressionAttributeNames:  filter.attributeNames(),
+		ExpressionAttributeValues: filter.attributeValues(),
+	}
+	for {
+		out, err := a.db.Scan(ctx, input)
+		if err != nil {
+			return dbErrorResponse(ctx, err), nil
+		}
+		for _, car := range decodeCars(out.Items) {
+			data, _ := json.Marshal(car)
+			body.WriteString("data: ")
+			body.Write(data)
+			body.WriteString("\n\n")
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			break
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	body.WriteString("event: end\ndata: {}\n\n")
+
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       body.String(),
+		Headers: map[string]string{
+			"Content-Type":  "text/event-stream",
+			"Cache-Control": "no-cache",
+		},
+	}, nil
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// API Gateway buffers the whole Lambda response and caps it at 6 MB. For
+// reads that can exceed that, the stack can deploy a second copy of this
+// function behind a function URL with InvokeMode RESPONSE_STREAM and
+// STREAMING_MODE=true, which makes main start streamingHandler instead of
+// handler. The body is then written to the client page by page as DynamoDB
+// returns it, without the 6 MB ceiling.
+//
+// The streaming URL only serves the bulk reads:
+//
+//	GET /         every car matching the usual list filters, as {"items":[...]}
+//	GET /stream   the same cars as Server-Sent Events
+//
+// Everything else stays on the buffered API Gateway endpoint. Once the first
+// byte is sent the status can no longer change, so a DynamoDB error part way
+// through ends the body early and is only visible in the logs.
+func streamingMode() bool {
+	return os.Getenv("STREAMING_MODE") == "true"
+}
+
+func (a *App) streamingHandler(ctx context.Context, req events.LambdaFunctionURLRequest) (*events.LambdaFunctionURLStreamingResponse, error) {
+	logger := slog.Default().With("requestId", req.RequestContext.RequestID)
+	logger.Info("streaming request", "method", req.RequestContext.HTTP.Method, "path", req.RawPath)
+	ctx = withLogger(withRequestID(ctx, req.RequestContext.RequestID), logger)
+
+	if req.RequestContext.HTTP.Method != "GET" {
+		return bufferedStreamingResponse(req.Headers["origin"], errorResponse(http.StatusMethodNotAllowed, "METHOD_NOT_ALLOWED", "the streaming endpoint only serves GET")), nil
+	}
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return bufferedStreamingResponse(req.Headers["origin"], handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set"))), nil
+	}
+	// The function URL has no admin auth, so soft-deleted cars stay hidden.
+	if req.QueryStringParameters["includeDeleted"] == "true" {
+		return bufferedStreamingResponse(req.Headers["origin"], errorResponse(http.StatusForbidden, "FORBIDDEN", "includeDeleted is not available on the streaming endpoint")), nil
+	}
+	filter, err := buildListFilter(req.QueryStringParameters)
+	if err != nil {
+		return bufferedStreamingResponse(req.Headers["origin"], errorResponse(http.StatusBadRequest, "INVALID_PARAMETER", err.Error())), nil
+	}
+	carMake := req.QueryStringParameters["make"]
+
+	var contentType string
+	var writeCar func(w io.Writer, i int, data []byte)
+	var open, end string
+	switch req.RawPath {
+	case "/", "":
+		contentType = "application/json"
+		open, end = `{"items":[`, "]}"
+		writeCar = func(w io.Writer, i int, data []byte) {
+			if i > 0 {
+				io.WriteString(w, ",")
+			}
+			w.Write(data)
+		}
+	case "/stream":
+		contentType = "text/event-stream"
+		end = "event: end\ndata: {}\n\n"
+		writeCar = func(w io.Writer, _ int, data []byte) {
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+	default:
+		return bufferedStreamingResponse(req.Headers["origin"], errorResponse(http.StatusNotFound, "NOT_FOUND", "not found")), nil
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		io.WriteString(pw, open)
+		n := 0
+		var startKey map[string]types.AttributeValue
+		for {
+			items, lastKey, err := a.listItems(ctx, TableNameEnv, carMake, filter, maxPageSize, startKey)
+			if err != nil {
+				logger.Error("streaming list failed", "sent", n, "error", err)
+				pw.CloseWithError(err)
+				return
+			}
+			for _, car := range decodeCars(items) {
+				data, _ := json.Marshal(car)
+				writeCar(pw, n, data)
+				n++
+			}
+			if len(lastKey) == 0 {
+				break
+			}
+			startKey = lastKey
+		}
+		io.WriteString(pw, end)
+		pw.Close()
+	}()
+
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: http.StatusOK,
+		Headers:    withCORS(events.APIGatewayV2HTTPResponse{Headers: map[string]string{"Content-Type": contentType}}, req.Headers["origin"]).Headers,
+		Body:       pr,
+	}, nil
+}
+
+// bufferedStreamingResponse sends an already built response over the
+// streaming URL, used for errors detected before streaming starts.
+func bufferedStreamingResponse(origin string, resp events.APIGatewayV2HTTPResponse) *events.LambdaFunctionURLStreamingResponse {
+	resp = withCORS(resp, origin)
+	return &events.LambdaFunctionURLStreamingResponse{
+		StatusCode: resp.StatusCode,
+		Headers:    resp.Headers,
+		Body:       strings.NewReader(resp.Body),
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// Right after the first `pulumi up` the table can still be CREATING, and
+// requests against it fail with confusing errors. route asks tableReady
+// first and answers 503 TABLE_INITIALIZING with Retry-After instead.
+//
+// The DescribeTable result is cached: once the table has been seen ACTIVE
+// it is not checked again for the life of the container, otherwise it is
+// re-checked after tableStatusRecheck.
+const (
+	tableStatusRecheck = 5 * time.Second
+	tableRetryAfter    = 5
+)
+
+var tableStatusCache struct {
+	sync.Mutex
+	status    types.TableStatus
+	checkedAt time.Time
+}
+
+// tableReady returns false with a 503 response while the table is CREATING.
+// UPDATING is let through: the table keeps serving while an index backfills
+// or a replica is added. So are a missing table and a failed DescribeTable,
+// which the handler reports the usual way.
+func (a *App) tableReady(ctx context.Context) (events.APIGatewayV2HTTPResponse, bool) {
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return events.APIGatewayV2HTTPResponse{}, true
+	}
+
+	status := a.cachedTableStatus(ctx, TableNameEnv)
+	if status != types.TableStatusCreating {
+		return events.APIGatewayV2HTTPResponse{}, true
+	}
+	resp := errorResponse(http.StatusServiceUnavailable, "TABLE_INITIALIZING", fmt.Sprintf("table is %s, please retry shortly", status))
+	resp.Headers["Retry-After"] = strconv.Itoa(tableRetryAfter)
+	return resp, false
+}
+
+func (a *App) cachedTableStatus(ctx context.Context, table string) types.TableStatus {
+	tableStatusCache.Lock()
+	defer tableStatusCache.Unlock()
+
+	if tableStatusCache.status == types.TableStatusActive ||
+		(tableStatusCache.status != "" && time.Since(tableStatusCache.checkedAt) < tableStatusRecheck) {
+		return tableStatusCache.status
+	}
+	out, err := a.db.DescribeTable(ctx, &dynamodb.DescribeTableInput{TableName: &table})
+	if err != nil {
+		loggerFrom(ctx).Warn("describe table failed", "table", table, "error", err)
+		return ""
+	}
+	tableStatusCache.status = out.Table.TableStatus
+	tableStatusCache.checkedAt = time.Now()
+	return tableStatusCache.status
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+// TLS is terminated before the request reaches the function, and the HTTP
+// API v2 event carries nothing about the client connection's TLS session:
+// requestContext has the domain, source IP and user agent, but no protocol
+// or cipher. API Gateway enforces the custom domain's security policy
+// (TLS 1.2 for the default) on its own.
+//
+// The version is only visible when CloudFront sits in front of the API and
+// its origin request policy forwards the CloudFront-Viewer-TLS header,
+// e.g. "TLSv1.3:TLS_AES_128_GCM_SHA256:sessionResumed". handler logs that
+// version with every request for compliance reporting, and checkTLSVersion
+// rejects older ones with 400 when MIN_TLS_VERSION is set (e.g. "TLSv1.2").
+// Requests without the header are logged as unknown and let through.
+var tlsVersionRank = map[string]int{
+	"SSLv3":   0,
+	"TLSv1":   1,
+	"TLSv1.1": 2,
+	"TLSv1.2": 3,
+	"TLSv1.3": 4,
+}
+
+// viewerTLSVersion returns the protocol part of CloudFront-Viewer-TLS, or ""
+// when the header is absent.
+func viewerTLSVersion(req events.APIGatewayV2HTTPRequest) string {
+	version, _, _ := strings.Cut(req.Headers["cloudfront-viewer-tls"], ":")
+	return version
+}
+
+// checkTLSVersion returns a 400 response with false when the negotiated TLS
+// version is below MIN_TLS_VERSION.
+func checkTLSVersion(req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, bool) {
+	version := viewerTLSVersion(req)
+	if version == "" {
+		return events.APIGatewayV2HTTPResponse{}, true
+	}
+
+	minimum := os.Getenv("MIN_TLS_VERSION")
+	minRank, ok := tlsVersionRank[minimum]
+	if !ok {
+		return events.APIGatewayV2HTTPResponse{}, true
+	}
+	if rank, known := tlsVersionRank[version]; known && rank < minRank {
+		return errorResponse(http.StatusBadRequest, "TLS_VERSION_TOO_LOW", fmt.Sprintf("%s is below the minimum %s", version, minimum)), false
+	}
+	return events.APIGatewayV2HTTPResponse{}, true
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-xray-sdk-go/instrumentation/awsv2"
+	"github.com/aws/aws-xray-sdk-go/strategy/ctxmissing"
+	"github.com/aws/aws-xray-sdk-go/xray"
+)
+
+// initTracing instruments every AWS client built from cfg so each call
+// (GetItem, PutItem, Scan, S3 puts, ...) shows up as an X-Ray subsegment of
+// the invocation's trace. Lambda creates the segment itself when the
+// function has active tracing, as the Pulumi stack configures.
+//
+// Calls made outside a traced invocation, such as the item cache's
+// background refreshes or local runs, have no segment to attach to; they are
+// simply not traced rather than logging an error each time.
+func initTracing(cfg *aws.Config) {
+	xray.Configure(xray.Config{ContextMissingStrategy: ctxmissing.NewDefaultIgnoreErrorStrategy()})
+	awsv2.AWSV2Instrumentor(&cfg.APIOptions)
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// With UNIQUE_MAKE_MODEL=true no two cars may share a make and model. Each
+// pair in use is claimed by a marker item in MAKE_MODEL_TABLE_NAME, keyed on
+// Make and Model and naming the car holding it in CarID. Creates and patches
+// that change the pair write the car and its new marker in one transaction,
+// so a conflicting write fails as a whole with 409 DUPLICATE_MAKE_MODEL.
+// Markers of a car's previous pair are released afterwards, on patch and on
+// delete; a release that fails is logged and leaves the pair blocked until
+// the marker is removed by hand.
+//
+// POST /batch can't use transactions, so its rows claim their markers one
+// by one before the write and release them if the write fails. A batch row
+// that overwrites an existing car with a different make and model doesn't
+// release the old car's marker.
+//
+// Cars written before the constraint was turned on have no markers, so
+// pairs that are already duplicated stay duplicated until one is changed.
+
+// errMakeModelTaken reports that another car already uses the make and model.
+var errMakeModelTaken = errors.New("make and model already used by another car")
+
+func uniqueMakeModelEnabled() bool {
+	return os.Getenv("UNIQUE_MAKE_MODEL") == "true"
+}
+
+// makeModelKey is the marker item key for a pair.
+func makeModelKey(carMake, model string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{
+		"Make":  &types.AttributeValueMemberS{Value: carMake},
+		"Model": &types.AttributeValueMemberS{Value: model},
+	}
+}
+
+// claimMarker is the Put that claims a pair for id. Claiming a pair the car
+// already holds succeeds, so retries are harmless.
+func claimMarker(table, carMake, model, id string) *types.Put {
+	item := makeModelKey(carMake, model)
+	item["CarID"] = &types.AttributeValueMemberS{Value: id}
+	return &types.Put{
+		TableName:                &table,
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#make) OR #carId = :id"),
+		ExpressionAttributeNames: map[string]string{"#make": "Make", "#carId": "CarID"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id},
+		},
+	}
+}
+
+// putNewCar writes a car that must not exist yet. A car with the same id
+// fails with *types.ConditionalCheckFailedException, a car with the same
+// make and model with errMakeModelTaken.
+func (a *App) putNewCar(ctx context.Context, table string, item map[string]types.AttributeValue, carMake, model, id string) error {
+	put := &types.Put{
+		TableName:                &table,
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]string{"#id": "ID"},
+	}
+	if !uniqueMakeModelEnabled() {
+		_, err := a.db.PutItem(ctx, &dynamodb.PutItemInput{
+			TableName:                put.TableName,
+			Item:                     put.Item,
+			ConditionExpression:      put.ConditionExpression,
+			ExpressionAttributeNames: put.ExpressionAttributeNames,
+		})
+		return err
+	}
+	markers := os.Getenv("MAKE_MODEL_TABLE_NAME")
+	if markers == "" {
+		return errors.New("MAKE_MODEL_TABLE_NAME environment variable is not set")
+	}
+	_, err := a.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{
+		TransactItems: []types.TransactWriteItem{
+			{Put: put},
+			{Put: claimMarker(markers, carMake, model, id)},
+		},
+	})
+	return transactionError(err)
+}
+
+// updateCar runs a PATCH UpdateItem. When the constraint is on and the patch
+// moves the car to another make and model, the update runs in a transaction
+// that also claims the new marker, and the old one is released afterwards.
+// Errors are reported as UpdateItem would, plus errMakeModelTaken.
+func (a *App) updateCar(ctx context.Context, in *dynamodb.UpdateItemInput, id string, patch carPatch) (map[string]types.AttributeValue, error) {
+	if !uniqueMakeModelEnabled() || (patch.Make == nil && patch.Model == nil) {
+		out, err := a.db.UpdateItem(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		return out.Attributes, nil
+	}
+	markers := os.Getenv("MAKE_MODEL_TABLE_NAME")
+	if markers == "" {
+		return nil, errors.New("MAKE_MODEL_TABLE_NAME environment variable is not set")
+	}
+
+	current, err := a.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      in.TableName,
+		Key:            in.Key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if current.Item == nil {
+		return nil, &types.ConditionalCheckFailedException{}
+	}
+	oldMake, oldModel := stringAttr(current.Item, "Make"), stringAttr(current.Item, "Model")
+	newMake, newModel := oldMake, oldModel
+	if patch.Make != nil {
+		newMake = *patch.Make
+	}
+	if patch.Model != nil {
+		newModel = *patch.Model
+	}
+	if newMake == oldMake && newModel == oldModel {
+		out, err := a.db.UpdateItem(ctx, in)
+		if err != nil {
+			return nil, err
+		}
+		return out.Attributes, nil
+	}
+
+	items := []types.TransactWriteItem{
+		{Update: &types.Update{
+			TableName:                           in.TableName,
+			Key:                                 in.Key,
+			UpdateExpression:                    in.UpdateExpression,
+			ConditionExpression:                 in.ConditionExpression,
+			ExpressionAttributeNames:            in.ExpressionAttributeNames,
+			ExpressionAttributeValues:           in.ExpressionAttributeValues,
+			ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+		}},
+		{Put: claimMarker(markers, newMake, newModel, id)},
+	}
+	_, err = a.db.TransactWriteItems(ctx, &dynamodb.TransactWriteItemsInput{TransactItems: items})
+	if err := transactionError(err); err != nil {
+		return nil, err
+	}
+	a.releaseMakeModels(ctx, current.Item)
+
+	// Transactions don't return the written item.
+	out, err := a.db.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      in.TableName,
+		Key:            in.Key,
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// releaseMarker is the Delete that frees a pair held by id. A missing marker
+// counts as released, and another car's marker is left alone.
+func releaseMarker(table, carMake, model, id string) *types.Delete {
+	return &types.Delete{
+		TableName:                &table,
+		Key:                      makeModelKey(carMake, model),
+		ConditionExpression:      aws.String("attribute_not_exists(#make) OR #carId = :id"),
+		ExpressionAttributeNames: map[string]string{"#make": "Make", "#carId": "CarID"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":id": &types.AttributeValueMemberS{Value: id},
+		},
+	}
+}
+
+// releaseMakeModels frees the markers held by the given deleted cars. It is
+// best effort: the cars are already gone, so failures are only logged.
+func (a *App) releaseMakeModels(ctx context.Context, cars ...map[string]types.AttributeValue) {
+	markers := os.Getenv("MAKE_MODEL_TABLE_NAME")
+	if !uniqueMakeModelEnabled() || markers == "" {
+		return
+	}
+	for _, car := range cars {
+		id, carMake, model := stringAttr(car, "ID"), stringAttr(car, "Make"), stringAttr(car, "Model")
+		if carMake == "" || model == "" {
+			continue
+		}
+		if err := a.deleteMarker(ctx, releaseMarker(markers, carMake, model, id)); err != nil {
+			loggerFrom(ctx).Error("releasing make and model failed", "id", id, "make", carMake, "model", model, "error", err)
+		}
+	}
+}
+
+// releaseMarkersOfMake frees the markers of a make that are held by one of
+// ids, used after a bulk delete where only the ids are known.
+func (a *App) releaseMarkersOfMake(ctx context.Context, carMake string, ids []string) {
+	markers := os.Getenv("MAKE_MODEL_TABLE_NAME")
+	if !uniqueMakeModelEnabled() || markers == "" || len(ids) == 0 {
+		return
+	}
+	deleted := make(map[string]bool, len(ids))
+	for _, id := range ids {
+		deleted[id] = true
+	}
+	input := &dynamodb.QueryInput{
+		TableName:                &markers,
+		KeyConditionExpression:   aws.String("#make = :make"),
+		ExpressionAttributeNames: map[string]string{"#make": "Make"},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":make": &types.AttributeValueMemberS{Value: carMake},
+		},
+	}
+	for {
+		out, err := a.db.Query(ctx, input)
+		if err != nil {
+			loggerFrom(ctx).Error("releasing make and model failed", "make", carMake, "error", err)
+			return
+		}
+		for _, marker := range out.Items {
+			if id := stringAttr(marker, "CarID"); deleted[id] {
+				a.releaseMakeModels(ctx, map[string]types.AttributeValue{
+					"ID":    marker["CarID"],
+					"Make":  marker["Make"],
+					"Model": marker["Model"],
+				})
+			}
+		}
+		if len(out.LastEvaluatedKey) == 0 {
+			return
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// claimMakeModel claims a pair outside a transaction, for POST /batch.
+func (a *App) claimMakeModel(ctx context.Context, carMake, model, id string) error {
+	markers := os.Getenv("MAKE_MODEL_TABLE_NAME")
+	if markers == "" {
+		return errors.New("MAKE_MODEL_TABLE_NAME environment variable is not set")
+	}
+	put := claimMarker(markers, carMake, model, id)
+	_, err := a.db.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName:                 put.TableName,
+		Item:                      put.Item,
+		ConditionExpression:       put.ConditionExpression,
+		ExpressionAttributeNames:  put.ExpressionAttributeNames,
+		ExpressionAttributeValues: put.ExpressionAttributeValues,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return errMakeModelTaken
+	}
+	return err
+}
+
+func (a *App) deleteMarker(ctx context.Context, del *types.Delete) error {
+	_, err := a.db.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName:                 del.TableName,
+		Key:                       del.Key,
+		ConditionExpression:       del.ConditionExpression,
+		ExpressionAttributeNames:  del.ExpressionAttributeNames,
+		ExpressionAttributeValues: del.ExpressionAttributeValues,
+	})
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		return nil
+	}
+	return err
+}
+
+// transactionError maps a cancelled car+marker transaction onto the errors
+// the single-item calls return: a failed condition on the car (always the
+// first item) becomes *types.ConditionalCheckFailedException carrying the
+// item, one on a marker errMakeModelTaken.
+func transactionError(err error) error {
+	var tce *types.TransactionCanceledException
+	if !errors.As(err, &tce) {
+		return err
+	}
+	for i, reason := range tce.CancellationReasons {
+		if aws.ToString(reason.Code) != "ConditionalCheckFailed" {
+			continue
+		}
+		if i == 0 {
+			return &types.ConditionalCheckFailedException{Message: reason.Message, Item: reason.Item}
+		}
+		return errMakeModelTaken
+	}
+	return err
+}
+
+// stringAttr returns the named string attribute, or "" when it is missing or
+// not a string.
+func stringAttr(item map[string]types.AttributeValue, name string) string {
+	if s, ok := item[name].(*types.AttributeValueMemberS); ok {
+		return s.Value
+	}
+	return ""
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/feature/dynamodb/attributevalue"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// carPatch is the body of a PATCH request. Only the fields that are present
+// get updated. The version comes from If-Match (or, with REQUIRE_IF_MATCH=
+// false, from the body) and must match the stored car's version, so a client
+// can't overwrite a change it hasn't seen.
+type carPatch struct {
+	Make    *string `json:"make"`
+	Model   *string `json:"model"`
+	Year    *int    `json:"year"`
+	Version *int    `json:"version"`
+}
+
+// defaultMaxPatchFields is how many attributes one PATCH may set when
+// MAX_PATCH_FIELDS is not set; version doesn't count.
+const defaultMaxPatchFields = 3
+
+// Attributes that must already exist on a record before it can be patched,
+// unless the patch itself sets them. Overridden by UPDATE_REQUIRED_ATTRIBUTES.
+const defaultUpdateRequiredAttributes = "Make,Model"
+
+func (a *App) handlePatch(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	id := carID(req)
+	if id == "" {
+		return errorResponse(http.StatusBadRequest, "MISSING_PARAMETER", "id query parameter is required"), nil
+	}
+
+	// Only known Car attributes may be patched, and at most maxPatchFields
+	// of them at once, which bounds the UpdateExpression built below.
+	var patch carPatch
+	dec := json.NewDecoder(strings.NewReader(req.Body))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&patch); err != nil {
+		if strings.HasPrefix(err.Error(), "json: unknown field") {
+			return errorResponse(http.StatusBadRequest, "INVALID_BODY", strings.TrimPrefix(err.Error(), "json: ")), nil
+		}
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "invalid request body"), nil
+	}
+	if n, limit := patch.fieldCount(), maxPatchFields(); n > limit {
+		return errorResponse(http.StatusBadRequest, "TOO_MANY_FIELDS", fmt.Sprintf("too many fields: %d set, at most %d allowed per update", n, limit)), nil
+	}
+	return a.applyPatch(ctx, req, id, patch)
+}
+
+// handlePut serves PUT /cars/{id}, replacing make, model and year of an
+// existing car in one go. The body is a whole car, validated as on POST; an
+// id in it must match the path. It is otherwise a PATCH setting every
+// field, with the same If-Match, version and make/model rules, and it can't
+// create a car: a missing id is 404.
+func (a *App) handlePut(ctx context.Context, req events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	id := carID(req)
+	if id == "" {
+		return errorResponse(http.StatusBadRequest, "MISSING_PARAMETER", "id path parameter is required"), nil
+	}
+
+	var item Car
+	if err := json.Unmarshal([]byte(req.Body), &item); errors.Is(err, errYearNotWhole) {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", err.Error()), nil
+	} else if err != nil {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "invalid request body"), nil
+	}
+	if err := item.Validate(); err != nil {
+		return validationResponse(err), nil
+	}
+	if item.ID != "" && item.ID != id {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "id in the body does not match the path"), nil
+	}
+
+	patch := carPatch{Make: &item.Make, Model: &item.Model, Year: &item.Year}
+	if item.Version != 0 {
+		patch.Version = &item.Version
+	}
+	return a.applyPatch(ctx, req, id, patch)
+}
+
+// applyPatch runs a decoded PATCH or PUT against the car with the given id.
+func (a *App) applyPatch(ctx context.Context, req events.APIGatewayV2HTTPRequest, id string, patch carPatch) (events.APIGatewayV2HTTPResponse, error) {
+	// If-Match stands in for the body's version; both may be sent if they
+	// agree.
+	ifMatch := req.Headers["if-match"]
+	if ifMatch == "" && ifMatchRequired() {
+		return errorResponse(http.StatusPreconditionRequired, "PRECONDITION_REQUIRED", "If-Match header is required"), nil
+	}
+	if ifMatch != "" {
+		version, ok := etagVersion(ifMatch)
+		if !ok || (patch.Version != nil && *patch.Version != version) {
+			return errorResponse(http.StatusPreconditionFailed, "PRECONDITION_FAILED", "If-Match does not match the car's current ETag"), nil
+		}
+		patch.Version = &version
+	}
+	if err := patch.Validate(); err != nil {
+		return validationResponse(err), nil
+	}
+
+	TableNameEnv := a.table
+	if TableNameEnv == "" {
+		return handleInternalError(ctx, errors.New("TABLE_NAME environment variable is not set")), nil
+	}
+
+	names := map[string]string{"#id": "ID"}
+	values := map[string]types.AttributeValue{}
+	var sets []string
+	if patch.Make != nil {
+		names["#make"] = "Make"
+		values[":make"] = &types.AttributeValueMemberS{Value: *patch.Make}
+		sets = append(sets, "#make = :make")
+	}
+	if patch.Model != nil {
+		names["#model"] = "Model"
+		values[":model"] = &types.AttributeValueMemberS{Value: *patch.Model}
+		sets = append(sets, "#model = :model")
+	}
+	if patch.Year != nil {
+		names["#year"] = "Year"
+		values[":year"] = &types.AttributeValueMemberN{Value: fmt.Sprintf("%d", *patch.Year)}
+		sets = append(sets, "#year = :year")
+	}
+	if len(sets) == 0 {
+		return errorResponse(http.StatusBadRequest, "INVALID_BODY", "no fields to update"), nil
+	}
+
+	seq, err := a.nextChangeSeq(ctx)
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	names["#changeSeq"] = "ChangeSeq"
+	names["#changeFeed"] = "ChangeFeed"
+	values[":changeSeq"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(seq, 10)}
+	values[":changeFeed"] = &types.AttributeValueMemberS{Value: changeFeedName}
+	sets = append(sets, "#changeSeq = :changeSeq", "#changeFeed = :changeFeed")
+	// Cars created before timestamps existed get CreatedAt backfilled with
+	// the time of their first update.
+	names["#createdAt"] = "CreatedAt"
+	names["#updatedAt"] = "UpdatedAt"
+	values[":now"] = &types.AttributeValueMemberS{Value: nowTimestamp()}
+	sets = append(sets, "#createdAt = if_not_exists(#createdAt, :now)", "#updatedAt = :now")
+	names["#version"] = "Version"
+	values[":nextVersion"] = &types.AttributeValueMemberN{Value: strconv.Itoa(*patch.Version + 1)}
+	sets = append(sets, "#version = :nextVersion")
+
+	// Guard against creating a new item and against patching corrupt rows
+	// that are missing attributes this patch doesn't fill in.
+	// Patching a draft from POST /cars/reserve promotes it, unless it has
+	// lapsed.
+	names["#deleted"] = "Deleted"
+	names["#status"] = draftStatusAttribute
+	names["#expiresAt"] = draftExpiryAttribute
+	values[":nowEpoch"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(time.Now().Unix(), 10)}
+	conditions := []string{"attribute_exists(#id)", "attribute_not_exists(#deleted)", "(attribute_not_exists(#status) OR #expiresAt > :nowEpoch)"}
+	if *patch.Version == 0 {
+		conditions = append(conditions, "attribute_not_exists(#version)")
+	} else {
+		values[":version"] = &types.AttributeValueMemberN{Value: strconv.Itoa(*patch.Version)}
+		conditions = append(conditions, "#version = :version")
+	}
+	var required []string
+	for i, attr := range updateRequiredAttributes() {
+		if patchSets(patch, attr) {
+			continue
+		}
+		placeholder := fmt.Sprintf("#req%d", i)
+		names[placeholder] = attr
+		conditions = append(conditions, fmt.Sprintf("attribute_exists(%s)", placeholder))
+		required = append(required, attr)
+	}
+
+	attrs, err := a.updateCar(ctx, &dynamodb.UpdateItemInput{
+		TableName: &TableNameEnv,
+		Key: map[string]types.AttributeValue{
+			"ID": &types.AttributeValueMemberS{Value: id},
+		},
+		UpdateExpression:                    aws.String("SET " + strings.Join(sets, ", ") + " REMOVE #status, #expiresAt"),
+		ConditionExpression:                 aws.String(strings.Join(conditions, " AND ")),
+		ExpressionAttributeNames:            names,
+		ExpressionAttributeValues:           values,
+		ReturnValues:                        types.ReturnValueAllNew,
+		ReturnValuesOnConditionCheckFailure: types.ReturnValuesOnConditionCheckFailureAllOld,
+	}, id, patch)
+	if errors.Is(err, errMakeModelTaken) {
+		return errorResponse(http.StatusConflict, "DUPLICATE_MAKE_MODEL", errMakeModelTaken.Error()), nil
+	}
+	var ccf *types.ConditionalCheckFailedException
+	if errors.As(err, &ccf) {
+		if len(ccf.Item) == 0 || isSoftDeleted(ccf.Item) || isLapsedDraft(ccf.Item) {
+			return errorResponse(http.StatusNotFound, "NOT_FOUND", "item not found"), nil
+		}
+		var current Car
+		if err := attributevalue.UnmarshalMap(ccf.Item, &current); err == nil && current.Version != *patch.Version {
+			if ifMatch != "" {
+				return errorResponse(http.StatusPreconditionFailed, "PRECONDITION_FAILED", fmt.Sprintf("car was modified: current ETag is %s", carETag(current.Version))), nil
+			}
+			return errorResponse(http.StatusConflict, "VERSION_CONFLICT", fmt.Sprintf("car was modified: version %d is stale, current version is %d", *patch.Version, current.Version)), nil
+		}
+		return errorResponse(http.StatusUnprocessableEntity, "MISSING_ATTRIBUTES", fmt.Sprintf("item is missing required attributes (%s) and cannot be patched", strings.Join(required, ", "))), nil
+	}
+	if err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+
+	invalidateCachedItems(id)
+	mirrorPut(attrs)
+
+	var item Car
+	if err := attributevalue.UnmarshalMap(attrs, &item); err != nil {
+		return dbErrorResponse(ctx, err), nil
+	}
+	body, _ := json.Marshal(item)
+	return events.APIGatewayV2HTTPResponse{
+		StatusCode: http.StatusOK,
+		Body:       string(body),
+		Headers:    map[string]string{"Content-Type": "application/json", "ETag": carETag(item.Version)},
+	}, nil
+}
+
+// fieldCount returns how many attributes the patch sets.
+func (p carPatch) fieldCount() int {
+	n := 0
+	for _, set := range []bool{p.Make != nil, p.Model != nil, p.Year != nil} {
+		if set {
+			n++
+		}
+	}
+	return n
+}
+
+// maxPatchFields reads MAX_PATCH_FIELDS, falling back to
+// defaultMaxPatchFields when it is unset or invalid.
+func maxPatchFields() int {
+	if n, err := strconv.Atoi(os.Getenv("MAX_PATCH_FIELDS")); err == nil && n > 0 {
+		return n
+	}
+	return defaultMaxPatchFields
+}
+
+// updateRequiredAttributes reads the comma-separated
+// UPDATE_REQUIRED_ATTRIBUTES list. Setting it to "none" disables the checks.
+func updateRequiredAttributes() []string {
+	raw, ok := os.LookupEnv("UPDATE_REQUIRED_ATTRIBUTES")
+	if !ok {
+		raw = defaultUpdateRequiredAttributes
+	}
+	if raw == "none" {
+		return nil
+	}
+	var attrs []string
+	for _, attr := range strings.Split(raw, ",") {
+		if attr = strings.TrimSpace(attr); attr != "" {
+			attrs = append(attrs, attr)
+		}
+	}
+	return attrs
+}
+
+// patchSets reports whether the patch writes the given attribute.
+func patchSets(patch carPatch, attr string) bool {
+	switch attr {
+	case "Make":
+		return patch.Make != nil
+	case "Model":
+		return patch.Model != nil
+	case "Year":
+		return patch.Year != nil
+	}
+	return false
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// The first production automobile, the Benz Patent-Motorwagen.
+	minCarYear = 1886
+	// maxFieldLength caps Make and Model after trimming whitespace.
+	maxFieldLength = 100
+)
+
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// validationError lists every field that failed validation.
+type validationError struct {
+	Fields []fieldError `json:"errors"`
+}
+
+func (e *validationError) Error() string {
+	msgs := make([]string, 0, len(e.Fields))
+	for _, f := range e.Fields {
+		msgs = append(msgs, f.Field+": "+f.Message)
+	}
+	return "invalid car: " + strings.Join(msgs, "; ")
+}
+
+func (e *validationError) add(field, message string) {
+	e.Fields = append(e.Fields, fieldError{Field: field, Message: message})
+}
+
+// orNil returns e as an error only if something was recorded.
+func (e *validationError) orNil() error {
+	if len(e.Fields) == 0 {
+		return nil
+	}
+	return e
+}
+
+// Validate checks a car before it is written. The returned error is a
+// *validationError describing each offending field, or a *makeNotAllowedError
+// when the fields are well-formed but the make isn't in ALLOWED_MAKES.
+func (c Car) Validate() error {
+	v := &validationError{}
+	validateText(v, "make", c.Make)
+	validateText(v, "model", c.Model)
+	validateYear(v, c.Year)
+	if err := v.orNil(); err != nil {
+		return err
+	}
+	return checkAllowedMake(c.Make)
+}
+
+// Validate checks the fields present in the patch and that it names the
+// version it is based on.
+func (p carPatch) Validate() error {
+	v := &validationError{}
+	if p.Make != nil {
+		validateText(v, "make", *p.Make)
+	}
+	if p.Model != nil {
+		validateText(v, "model", *p.Model)
+	}
+	if p.Year != nil {
+		validateYear(v, *p.Year)
+	}
+	switch {
+	case p.Version == nil:
+		v.add("version", "is required")
+	case *p.Version < 0:
+		v.add("version", "must not be negative")
+	}
+	if err := v.orNil(); err != nil || p.Make == nil {
+		return err
+	}
+	return checkAllowedMake(*p.Make)
+}
+
+// makeNotAllowedError reports a make outside the ALLOWED_MAKES list.
+type makeNotAllowedError struct {
+	Make    string
+	Allowed []string
+}
+
+func (e *makeNotAllowedError) Error() string {
+	return fmt.Sprintf("make %q is not allowed", e.Make)
+}
+
+// allowedMakes reads the optional comma-separated ALLOWED_MAKES list. An
+// empty result means any make is accepted.
+func allowedMakes() []string {
+	var makes []string
+	for _, m := range strings.Split(os.Getenv("ALLOWED_MAKES"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			makes = append(makes, m)
+		}
+	}
+	return makes
+}
+
+// checkAllowedMake matches carMake against ALLOWED_MAKES, ignoring case and
+// surrounding whitespace.
+func checkAllowedMake(carMake string) error {
+	allowed := allowedMakes()
+	if len(allowed) == 0 {
+		return nil
+	}
+	trimmed := strings.TrimSpace(carMake)
+	for _, m := range allowed {
+		if strings.EqualFold(m, trimmed) {
+			return nil
+		}
+	}
+	return &makeNotAllowedError{Make: trimmed, Allowed: allowed}
+}
+
+func validateText(v *validationError, field, value string) {
+	trimmed := strings.TrimSpace(value)
+	switch {
+	case trimmed == "":
+		v.add(field, "must not be empty")
+	case utf8.RuneCountInString(trimmed) > maxFieldLength:
+		v.add(field, fmt.Sprintf("must be at most %d characters", maxFieldLength))
+	}
+}
+
+func validateYear(v *validationError, year int) {
+	maxYear := time.Now().Year() + 1
+	if year < minCarYear || year > maxYear {
+		v.add("year", fmt.Sprintf("must be between %d and %d", minCarYear, maxYear))
+	}
+}
+
+// validationResponse reports a *validationError as 400 VALIDATION_FAILED,
+// listing the offending fields, and a *makeNotAllowedError as 422
+// MAKE_NOT_ALLOWED with the accepted makes.
+func validationResponse(err error) events.APIGatewayV2HTTPResponse {
+	if m, ok := err.(*makeNotAllowedError); ok {
+		return errorEnvelopeResponse(http.StatusUnprocessableEntity, apiError{
+			Code:    "MAKE_NOT_ALLOWED",
+			Message: m.Error(),
+			Allowed: m.Allowed,
+		})
+	}
+	e := apiError{Code: "VALIDATION_FAILED", Message: err.Error()}
+	if v, ok := err.(*validationError); ok {
+		e.Fields = v.Fields
+	}
+	return errorEnvelopeResponse(http.StatusBadRequest, e)
+}
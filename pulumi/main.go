@@ -1,34 +1,211 @@
 package main
 
 import (
+	"fmt"
+	"strings"
+
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/apigatewayv2"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/cloudwatch"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/dynamodb"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/iam"
 	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/lambda"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/s3"
+	"github.com/pulumi/pulumi-aws/sdk/v6/go/aws/sqs"
 	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi/config"
 )
 
 func main() {
-	pulumi.Run(func(ctx *pulumi.Context) error {
+	pulumi.Run(createInfra)
+}
 
-		// Create a DynamoDB table
-		table, err := dynamodb.NewTable(ctx, "MyItems", &dynamodb.TableArgs{
-			Attributes: dynamodb.TableAttributeArray{
-				&dynamodb.TableAttributeArgs{
-					Name: pulumi.String("ID"),
-					Type: pulumi.String("S"),
-				},
+// createInfra declares the stack. It is kept out of main so tests can run it
+// against mocked resources.
+func createInfra(ctx *pulumi.Context) error {
+	conf := config.New(ctx, "")
+
+	// Create a DynamoDB table
+	tableArgs := &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("ID"),
+				Type: pulumi.String("S"),
 			},
-			HashKey:     pulumi.String("ID"),
-			BillingMode: pulumi.String("PAY_PER_REQUEST"),
-		})
-		if err != nil {
-			return err
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Make"),
+				Type: pulumi.String("S"),
+			},
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("ChangeFeed"),
+				Type: pulumi.String("S"),
+			},
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("ChangeSeq"),
+				Type: pulumi.String("N"),
+			},
+		},
+		HashKey:     pulumi.String("ID"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+		// Change data capture for the stream processor below; Global
+		// Tables replication needs the same view type
+		StreamEnabled:  pulumi.Bool(true),
+		StreamViewType: pulumi.String("NEW_AND_OLD_IMAGES"),
+		// Lets the Lambda query cars by make instead of scanning
+		GlobalSecondaryIndexes: dynamodb.TableGlobalSecondaryIndexArray{
+			&dynamodb.TableGlobalSecondaryIndexArgs{
+				Name:           pulumi.String("MakeIndex"),
+				HashKey:        pulumi.String("Make"),
+				ProjectionType: pulumi.String("ALL"),
+			},
+			// Change feed ordered by the global write sequence
+			&dynamodb.TableGlobalSecondaryIndexArgs{
+				Name:           pulumi.String("ChangeIndex"),
+				HashKey:        pulumi.String("ChangeFeed"),
+				RangeKey:       pulumi.String("ChangeSeq"),
+				ProjectionType: pulumi.String("ALL"),
+			},
+		},
+		// Evicts id reservations that were never promoted to cars
+		Ttl: &dynamodb.TableTtlArgs{
+			AttributeName: pulumi.String("ExpiresAt"),
+			Enabled:       pulumi.Bool(true),
+		},
+	}
+
+	// Optional Global Tables replicas for multi-region active-active,
+	// e.g. `pulumi config set --path 'replicaRegions[0]' eu-west-1`.
+	// Replication uses the table's stream, which is always enabled.
+	var replicaRegions []string
+	if err := conf.GetObject("replicaRegions", &replicaRegions); err != nil {
+		return err
+	}
+	if len(replicaRegions) > 0 {
+		replicas := dynamodb.TableReplicaTypeArray{}
+		for _, region := range replicaRegions {
+			replicas = append(replicas, &dynamodb.TableReplicaTypeArgs{
+				RegionName: pulumi.String(region),
+			})
 		}
+		tableArgs.Replicas = replicas
+	}
+
+	table, err := dynamodb.NewTable(ctx, "MyItems", tableArgs)
+	if err != nil {
+		return err
+	}
+
+	// Short-lived confirmation tokens for two-phase bulk deletes. Expired
+	// tokens are evicted by DynamoDB TTL.
+	confirmTable, err := dynamodb.NewTable(ctx, "DeleteConfirmations", &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Token"),
+				Type: pulumi.String("S"),
+			},
+		},
+		HashKey:     pulumi.String("Token"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+		Ttl: &dynamodb.TableTtlArgs{
+			AttributeName: pulumi.String("ExpiresAt"),
+			Enabled:       pulumi.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
 
-		// IAM Role for Lambda
-		lambdaRole, err := iam.NewRole(ctx, "lambdaRole", &iam.RoleArgs{
-			AssumeRolePolicy: pulumi.String(`{
+	// Atomic counters, currently just the change feed sequence.
+	countersTable, err := dynamodb.NewTable(ctx, "Counters", &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Name"),
+				Type: pulumi.String("S"),
+			},
+		},
+		HashKey:     pulumi.String("Name"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Tombstones for deleted cars so the change feed can report deletes.
+	// They expire via DynamoDB TTL after TOMBSTONE_TTL_DAYS.
+	tombstonesTable, err := dynamodb.NewTable(ctx, "ChangeTombstones", &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Feed"),
+				Type: pulumi.String("S"),
+			},
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Seq"),
+				Type: pulumi.String("N"),
+			},
+		},
+		HashKey:     pulumi.String("Feed"),
+		RangeKey:    pulumi.String("Seq"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+		Ttl: &dynamodb.TableTtlArgs{
+			AttributeName: pulumi.String("ExpiresAt"),
+			Enabled:       pulumi.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Markers claiming each make and model pair in use, for the optional
+	// uniqueness constraint on the pair.
+	makeModelTable, err := dynamodb.NewTable(ctx, "MakeModels", &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Make"),
+				Type: pulumi.String("S"),
+			},
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Model"),
+				Type: pulumi.String("S"),
+			},
+		},
+		HashKey:     pulumi.String("Make"),
+		RangeKey:    pulumi.String("Model"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Idempotency-Key records for POST, evicted by DynamoDB TTL once the
+	// replay window has passed.
+	idempotencyTable, err := dynamodb.NewTable(ctx, "IdempotencyKeys", &dynamodb.TableArgs{
+		Attributes: dynamodb.TableAttributeArray{
+			&dynamodb.TableAttributeArgs{
+				Name: pulumi.String("Key"),
+				Type: pulumi.String("S"),
+			},
+		},
+		HashKey:     pulumi.String("Key"),
+		BillingMode: pulumi.String("PAY_PER_REQUEST"),
+		Ttl: &dynamodb.TableTtlArgs{
+			AttributeName: pulumi.String("ExpiresAt"),
+			Enabled:       pulumi.Bool(true),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// Bucket receiving table exports (part files plus a manifest)
+	exportBucket, err := s3.NewBucketV2(ctx, "exports", &s3.BucketV2Args{
+		ForceDestroy: pulumi.Bool(true),
+	})
+	if err != nil {
+		return err
+	}
+
+	// IAM Role for Lambda
+	lambdaRole, err := iam.NewRole(ctx, "lambdaRole", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
 				"Version": "2012-10-17",
 				"Statement": [{
 					"Action": "sts:AssumeRole",
@@ -39,111 +216,744 @@ func main() {
 					"Sid": ""
 				}]
 			}`),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Attach policies to Lambda
+	_, err = iam.NewRolePolicyAttachment(ctx, "lambdaBasicExec", &iam.RolePolicyAttachmentArgs{
+		Role:      lambdaRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Lets the Lambda send X-Ray trace segments
+	_, err = iam.NewRolePolicyAttachment(ctx, "lambdaXRayWrite", &iam.RolePolicyAttachmentArgs{
+		Role:      lambdaRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/AWSXRayDaemonWriteAccess"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicyAttachment(ctx, "lambdaDynamoAccess", &iam.RolePolicyAttachmentArgs{
+		Role:      lambdaRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/AmazonDynamoDBFullAccess"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "lambdaExportAccess", &iam.RolePolicyArgs{
+		Role: lambdaRole.Name,
+		Policy: pulumi.Sprintf(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": ["s3:PutObject", "s3:GetObject"],
+					"Resource": ["%s/exports/*", "%s/dead-letter/*"]
+				}, {
+					"Effect": "Allow",
+					"Action": "s3:ListBucket",
+					"Resource": "%s"
+				}]
+			}`, exportBucket.Arn, exportBucket.Arn, exportBucket.Arn),
+	})
+	if err != nil {
+		return err
+	}
+
+	lambdaEnv := pulumi.StringMap{
+		"TABLE_NAME":             table.Name, // dynamic table name
+		"CONFIRM_TABLE_NAME":     confirmTable.Name,
+		"COUNTERS_TABLE_NAME":    countersTable.Name,
+		"TOMBSTONES_TABLE_NAME":  tombstonesTable.Name,
+		"MAKE_MODEL_TABLE_NAME":  makeModelTable.Name,
+		"IDEMPOTENCY_TABLE_NAME": idempotencyTable.Name,
+		"EXPORT_BUCKET":          exportBucket.Bucket,
+	}
+
+	// Origin allowed to call the API from a browser; the Lambda defaults
+	// to * when unset
+	if origin := conf.Get("allowedOrigin"); origin != "" {
+		lambdaEnv["ALLOWED_ORIGIN"] = pulumi.String(origin)
+	}
+
+	// Browser origins allowed to call the API, e.g.
+	// `pulumi config set --path 'allowedOrigins[0]' https://app.example.com`.
+	// The Lambda gets them too, for the streaming function URL.
+	var allowedOrigins []string
+	if err := conf.GetObject("allowedOrigins", &allowedOrigins); err != nil {
+		return err
+	}
+	if len(allowedOrigins) > 0 {
+		lambdaEnv["ALLOWED_ORIGINS"] = pulumi.String(strings.Join(allowedOrigins, ","))
+	}
+
+	// Reject a second car with the same make and model
+	if conf.GetBool("uniqueMakeModel") {
+		lambdaEnv["UNIQUE_MAKE_MODEL"] = pulumi.String("true")
+	}
+
+	// Optional SSM parameter holding shared config as a JSON object of
+	// environment variables, applied by the Lambda at cold start
+	if path := conf.Get("configSsmPath"); path != "" {
+		lambdaEnv["CONFIG_SSM_PATH"] = pulumi.String(path)
+		// Parameter ARNs always have a slash before the name
+		arnPath := path
+		if !strings.HasPrefix(arnPath, "/") {
+			arnPath = "/" + arnPath
+		}
+		_, err = iam.NewRolePolicy(ctx, "lambdaConfigAccess", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+					"Version": "2012-10-17",
+					"Statement": [{
+						"Effect": "Allow",
+						"Action": "ssm:GetParameter",
+						"Resource": "arn:aws:ssm:*:*:parameter%s"
+					}]
+				}`, arnPath),
 		})
 		if err != nil {
 			return err
 		}
+	}
 
-		// Attach policies to Lambda
-		_, err = iam.NewRolePolicyAttachment(ctx, "lambdaBasicExec", &iam.RolePolicyAttachmentArgs{
-			Role:      lambdaRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+	// Optional Secrets Manager secret holding ADMIN_TOKEN and
+	// RESPONSE_SIGNING_SECRET as a JSON object, instead of plain env vars
+	if secretsArn := conf.Get("secretsArn"); secretsArn != "" {
+		lambdaEnv["SECRETS_ARN"] = pulumi.String(secretsArn)
+		_, err = iam.NewRolePolicy(ctx, "lambdaSecretsAccess", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+					"Version": "2012-10-17",
+					"Statement": [{
+						"Effect": "Allow",
+						"Action": "secretsmanager:GetSecretValue",
+						"Resource": "%s"
+					}]
+				}`, secretsArn),
 		})
 		if err != nil {
 			return err
 		}
+	}
+
+	// Memory and timeout of the Lambda functions serving requests; the
+	// platform defaults (128 MB, 3 s) are too tight for a cold start
+	// followed by a slow DynamoDB call
+	lambdaMemoryMb := 256
+	if n := conf.GetInt("lambdaMemoryMb"); n > 0 {
+		lambdaMemoryMb = n
+	}
+	lambdaTimeoutSec := 10
+	if n := conf.GetInt("lambdaTimeoutSec"); n > 0 {
+		lambdaTimeoutSec = n
+	}
 
-		_, err = iam.NewRolePolicyAttachment(ctx, "lambdaDynamoAccess", &iam.RolePolicyAttachmentArgs{
-			Role:      lambdaRole.Name,
-			PolicyArn: pulumi.String("arn:aws:iam::aws:policy/AmazonDynamoDBFullAccess"),
+	// Optional async writes: POST queues the car on SQS and answers 202,
+	// and a worker function (created below) writes it to the table.
+	// Messages failing writeMaxReceives times move to a dead-letter queue.
+	asyncWrites := conf.GetBool("asyncWrites")
+	var writeQueue *sqs.Queue
+	if asyncWrites {
+		writeDlq, err := sqs.NewQueue(ctx, "writeDeadLetters", &sqs.QueueArgs{
+			MessageRetentionSeconds: pulumi.Int(14 * 24 * 60 * 60),
+		})
+		if err != nil {
+			return err
+		}
+		writeMaxReceives := 5
+		if n := conf.GetInt("writeMaxReceives"); n > 0 {
+			writeMaxReceives = n
+		}
+		writeQueue, err = sqs.NewQueue(ctx, "writes", &sqs.QueueArgs{
+			// At least six times the worker's timeout, as Lambda advises
+			VisibilityTimeoutSeconds: pulumi.Int(6 * lambdaTimeoutSec),
+			RedrivePolicy:            pulumi.Sprintf(`{"deadLetterTargetArn":"%s","maxReceiveCount":%d}`, writeDlq.Arn, writeMaxReceives),
 		})
 		if err != nil {
 			return err
 		}
 
-		// Create the Lambda function
-		myLambda, err := lambda.NewFunction(ctx, "myApiLambda", &lambda.FunctionArgs{
-			Runtime: pulumi.String("provided.al2023"),
-			Handler: pulumi.String("bootstrap"),
-			Code:    pulumi.NewFileArchive("../lambda/bootstrap.zip"),
-			Role:    lambdaRole.Arn,
-			Environment: &lambda.FunctionEnvironmentArgs{
-				Variables: pulumi.StringMap{
-					"TABLE_NAME": table.Name, // dynamic table name
+		// Status of each queued write, evicted by DynamoDB TTL
+		writeStatusTable, err := dynamodb.NewTable(ctx, "WriteStatus", &dynamodb.TableArgs{
+			Attributes: dynamodb.TableAttributeArray{
+				&dynamodb.TableAttributeArgs{
+					Name: pulumi.String("ID"),
+					Type: pulumi.String("S"),
 				},
 			},
+			HashKey:     pulumi.String("ID"),
+			BillingMode: pulumi.String("PAY_PER_REQUEST"),
+			Ttl: &dynamodb.TableTtlArgs{
+				AttributeName: pulumi.String("ExpiresAt"),
+				Enabled:       pulumi.Bool(true),
+			},
 		})
 		if err != nil {
 			return err
 		}
 
-		// API Gateway
-		api, err := apigatewayv2.NewApi(ctx, "httpApi", &apigatewayv2.ApiArgs{
-			ProtocolType: pulumi.String("HTTP"),
+		lambdaEnv["ASYNC_WRITES"] = pulumi.String("true")
+		lambdaEnv["WRITE_QUEUE_URL"] = writeQueue.Url
+		lambdaEnv["WRITE_STATUS_TABLE_NAME"] = writeStatusTable.Name
+
+		_, err = iam.NewRolePolicy(ctx, "lambdaWriteQueueAccess", &iam.RolePolicyArgs{
+			Role: lambdaRole.Name,
+			Policy: pulumi.Sprintf(`{
+					"Version": "2012-10-17",
+					"Statement": [{
+						"Effect": "Allow",
+						"Action": ["sqs:SendMessage", "sqs:ReceiveMessage", "sqs:DeleteMessage", "sqs:GetQueueAttributes"],
+						"Resource": "%s"
+					}]
+				}`, writeQueue.Arn),
 		})
 		if err != nil {
 			return err
 		}
+	}
+
+	// "ulid" makes server-generated ids time-sortable instead of UUIDv4
+	if idFormat := conf.Get("idFormat"); idFormat != "" {
+		lambdaEnv["ID_FORMAT"] = pulumi.String(idFormat)
+	}
+
+	// Optional best-effort mirror of writes to a table in another region
+	if region := conf.Get("replicaRegion"); region != "" {
+		lambdaEnv["REPLICA_REGION"] = pulumi.String(region)
+		lambdaEnv["REPLICA_TABLE"] = pulumi.String(conf.Require("replicaTable"))
+	}
+
+	// The function gets a fixed name so its log group can be created
+	// first, with a retention; left to Lambda, the group would be
+	// created on first invocation and kept forever
+	lambdaName := fmt.Sprintf("%s-%s-api", ctx.Project(), ctx.Stack())
+	logRetentionDays := 14
+	if n := conf.GetInt("logRetentionDays"); n > 0 {
+		logRetentionDays = n
+	}
+	lambdaLogs, err := cloudwatch.NewLogGroup(ctx, "myApiLambdaLogs", &cloudwatch.LogGroupArgs{
+		Name:            pulumi.String("/aws/lambda/" + lambdaName),
+		RetentionInDays: pulumi.Int(logRetentionDays),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Create the Lambda function
+	myLambda, err := lambda.NewFunction(ctx, "myApiLambda", &lambda.FunctionArgs{
+		Name:       pulumi.String(lambdaName),
+		Runtime:    pulumi.String("provided.al2023"),
+		Handler:    pulumi.String("bootstrap"),
+		Code:       pulumi.NewFileArchive("../lambda/bootstrap.zip"),
+		Role:       lambdaRole.Arn,
+		MemorySize: pulumi.Int(lambdaMemoryMb),
+		Timeout:    pulumi.Int(lambdaTimeoutSec),
+		Environment: &lambda.FunctionEnvironmentArgs{
+			Variables: lambdaEnv,
+		},
+		// Trace every invocation; the Lambda adds DynamoDB and S3
+		// subsegments
+		TracingConfig: &lambda.FunctionTracingConfigArgs{
+			Mode: pulumi.String("Active"),
+		},
+		// Publish a version on every code change so the alias below can
+		// shift traffic between versions
+		Publish: pulumi.Bool(true),
+	}, pulumi.DependsOn([]pulumi.Resource{lambdaLogs}))
+	if err != nil {
+		return err
+	}
 
-		integration, err := apigatewayv2.NewIntegration(ctx, "apiIntegration", &apigatewayv2.IntegrationArgs{
-			ApiId:                api.ID(),
-			IntegrationType:      pulumi.String("AWS_PROXY"),
-			IntegrationUri:       myLambda.Arn,
-			PayloadFormatVersion: pulumi.String("2.0"),
+	// Optional copy of the function behind a streaming function URL for
+	// bulk reads that would exceed API Gateway's 6 MB response limit
+	if conf.GetBool("streamingUrl") {
+		streamingEnv := pulumi.StringMap{
+			"STREAMING_MODE":         pulumi.String("true"),
+			"FUNCTION_URL_AUTH_TYPE": pulumi.String("NONE"),
+		}
+		for k, v := range lambdaEnv {
+			streamingEnv[k] = v
+		}
+		streamingLambda, err := lambda.NewFunction(ctx, "myApiStreamingLambda", &lambda.FunctionArgs{
+			Runtime:    pulumi.String("provided.al2023"),
+			Handler:    pulumi.String("bootstrap"),
+			Code:       pulumi.NewFileArchive("../lambda/bootstrap.zip"),
+			Role:       lambdaRole.Arn,
+			MemorySize: pulumi.Int(lambdaMemoryMb),
+			Timeout:    pulumi.Int(lambdaTimeoutSec),
+			Environment: &lambda.FunctionEnvironmentArgs{
+				Variables: streamingEnv,
+			},
+			TracingConfig: &lambda.FunctionTracingConfigArgs{
+				Mode: pulumi.String("Active"),
+			},
 		})
 		if err != nil {
 			return err
 		}
-
-		_, err = lambda.NewPermission(ctx, "apigwPermission", &lambda.PermissionArgs{
-			Action:    pulumi.String("lambda:InvokeFunction"),
-			Function:  myLambda.Name,
-			Principal: pulumi.String("apigateway.amazonaws.com"),
-			SourceArn: pulumi.Sprintf("%s/*/*", api.ExecutionArn),
+		url, err := lambda.NewFunctionUrl(ctx, "streamingUrl", &lambda.FunctionUrlArgs{
+			FunctionName:      streamingLambda.Name,
+			AuthorizationType: pulumi.String("NONE"),
+			InvokeMode:        pulumi.String("RESPONSE_STREAM"),
 		})
 		if err != nil {
 			return err
 		}
+		ctx.Export("streamingUrl", url.FunctionUrl)
+	}
 
-		_, err = apigatewayv2.NewRoute(ctx, "apiRoute", &apigatewayv2.RouteArgs{
-			ApiId:    api.ID(),
-			RouteKey: pulumi.String("$default"),
-			Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	// Worker draining the async write queue; it shares the API's role
+	// and environment, as it writes cars the same way POST does
+	if asyncWrites {
+		workerEnv := pulumi.StringMap{
+			"WRITE_WORKER": pulumi.String("true"),
+		}
+		for k, v := range lambdaEnv {
+			if k != "ASYNC_WRITES" {
+				workerEnv[k] = v
+			}
+		}
+		writeWorker, err := lambda.NewFunction(ctx, "myApiWriteWorker", &lambda.FunctionArgs{
+			Runtime:    pulumi.String("provided.al2023"),
+			Handler:    pulumi.String("bootstrap"),
+			Code:       pulumi.NewFileArchive("../lambda/bootstrap.zip"),
+			Role:       lambdaRole.Arn,
+			MemorySize: pulumi.Int(lambdaMemoryMb),
+			Timeout:    pulumi.Int(lambdaTimeoutSec),
+			Environment: &lambda.FunctionEnvironmentArgs{
+				Variables: workerEnv,
+			},
+			TracingConfig: &lambda.FunctionTracingConfigArgs{
+				Mode: pulumi.String("Active"),
+			},
 		})
 		if err != nil {
 			return err
 		}
-
-		_, err = apigatewayv2.NewRoute(ctx, "getRoute", &apigatewayv2.RouteArgs{
-			ApiId:    api.ID(),
-			RouteKey: pulumi.String("GET /"),
-			Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+		_, err = lambda.NewEventSourceMapping(ctx, "writeQueueMapping", &lambda.EventSourceMappingArgs{
+			EventSourceArn: writeQueue.Arn,
+			FunctionName:   writeWorker.Arn,
+			BatchSize:      pulumi.Int(10),
+			// Only the messages the worker reports as failed are retried
+			FunctionResponseTypes: pulumi.StringArray{pulumi.String("ReportBatchItemFailures")},
 		})
 		if err != nil {
 			return err
 		}
+	}
+
+	// Stream processor: a copy of the function with STREAM_PROCESSOR=true,
+	// fed by the table's stream. It has its own role that can only read
+	// the stream and write logs.
+	streamRole, err := iam.NewRole(ctx, "streamProcessorRole", &iam.RoleArgs{
+		AssumeRolePolicy: pulumi.String(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Action": "sts:AssumeRole",
+					"Principal": {
+						"Service": "lambda.amazonaws.com"
+					},
+					"Effect": "Allow",
+					"Sid": ""
+				}]
+			}`),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicyAttachment(ctx, "streamProcessorBasicExec", &iam.RolePolicyAttachmentArgs{
+		Role:      streamRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/service-role/AWSLambdaBasicExecutionRole"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicy(ctx, "streamProcessorStreamRead", &iam.RolePolicyArgs{
+		Role: streamRole.Name,
+		Policy: pulumi.Sprintf(`{
+				"Version": "2012-10-17",
+				"Statement": [{
+					"Effect": "Allow",
+					"Action": [
+						"dynamodb:DescribeStream",
+						"dynamodb:GetRecords",
+						"dynamodb:GetShardIterator",
+						"dynamodb:ListStreams"
+					],
+					"Resource": "%s"
+				}]
+			}`, table.StreamArn),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = iam.NewRolePolicyAttachment(ctx, "streamProcessorXRayWrite", &iam.RolePolicyAttachmentArgs{
+		Role:      streamRole.Name,
+		PolicyArn: pulumi.String("arn:aws:iam::aws:policy/AWSXRayDaemonWriteAccess"),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Same sizing, tracing and log retention as the API function
+	streamLambdaName := fmt.Sprintf("%s-%s-stream", ctx.Project(), ctx.Stack())
+	streamLogs, err := cloudwatch.NewLogGroup(ctx, "myApiStreamProcessorLogs", &cloudwatch.LogGroupArgs{
+		Name:            pulumi.String("/aws/lambda/" + streamLambdaName),
+		RetentionInDays: pulumi.Int(logRetentionDays),
+	})
+	if err != nil {
+		return err
+	}
+
+	streamLambda, err := lambda.NewFunction(ctx, "myApiStreamProcessor", &lambda.FunctionArgs{
+		Name:       pulumi.String(streamLambdaName),
+		Runtime:    pulumi.String("provided.al2023"),
+		Handler:    pulumi.String("bootstrap"),
+		Code:       pulumi.NewFileArchive("../lambda/bootstrap.zip"),
+		Role:       streamRole.Arn,
+		MemorySize: pulumi.Int(lambdaMemoryMb),
+		Timeout:    pulumi.Int(lambdaTimeoutSec),
+		Environment: &lambda.FunctionEnvironmentArgs{
+			Variables: pulumi.StringMap{
+				"STREAM_PROCESSOR": pulumi.String("true"),
+				"LOG_LEVEL":        pulumi.String("info"),
+			},
+		},
+		TracingConfig: &lambda.FunctionTracingConfigArgs{
+			Mode: pulumi.String("Active"),
+		},
+	}, pulumi.DependsOn([]pulumi.Resource{streamLogs}))
+	if err != nil {
+		return err
+	}
+
+	_, err = lambda.NewEventSourceMapping(ctx, "carsStreamMapping", &lambda.EventSourceMappingArgs{
+		EventSourceArn:   table.StreamArn,
+		FunctionName:     streamLambda.Arn,
+		StartingPosition: pulumi.String("LATEST"),
+		BatchSize:        pulumi.Int(100),
+	})
+	if err != nil {
+		return err
+	}
+
+	// API Gateway invokes the "live" alias. With canaryPercent set, the
+	// alias keeps pointing at stableVersion and sends that percentage of
+	// requests to the newly published version; without it the alias
+	// simply follows the latest version.
+	canaryPercent := conf.GetFloat64("canaryPercent")
+	if canaryPercent < 0 || canaryPercent >= 100 {
+		return fmt.Errorf("canaryPercent must be in [0, 100), got %v", canaryPercent)
+	}
+	aliasArgs := &lambda.AliasArgs{
+		Name:            pulumi.String("live"),
+		FunctionName:    myLambda.Name,
+		FunctionVersion: myLambda.Version,
+	}
+	if canaryPercent > 0 {
+		aliasArgs.FunctionVersion = pulumi.String(conf.Require("stableVersion"))
+		aliasArgs.RoutingConfig = &lambda.AliasRoutingConfigArgs{
+			AdditionalVersionWeights: myLambda.Version.ApplyT(func(v string) map[string]float64 {
+				return map[string]float64{v: canaryPercent / 100}
+			}).(pulumi.Float64MapOutput),
+		}
+	}
+	liveAlias, err := lambda.NewAlias(ctx, "liveAlias", aliasArgs)
+	if err != nil {
+		return err
+	}
+
+	// API Gateway
+	// CORS is handled by API Gateway, which answers preflight requests
+	// itself so the Lambda isn't invoked for OPTIONS.
+	if len(allowedOrigins) == 0 {
+		allowedOrigins = []string{"*"}
+	}
+
+	api, err := apigatewayv2.NewApi(ctx, "httpApi", &apigatewayv2.ApiArgs{
+		ProtocolType: pulumi.String("HTTP"),
+		CorsConfiguration: &apigatewayv2.ApiCorsConfigurationArgs{
+			AllowOrigins:  pulumi.ToStringArray(allowedOrigins),
+			AllowMethods:  pulumi.ToStringArray([]string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}),
+			AllowHeaders:  pulumi.ToStringArray([]string{"content-type", "authorization", "range", "idempotency-key", "if-match"}),
+			ExposeHeaders: pulumi.ToStringArray([]string{"content-range", "location", "x-route-key", "idempotent-replayed", "etag"}),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	integration, err := apigatewayv2.NewIntegration(ctx, "apiIntegration", &apigatewayv2.IntegrationArgs{
+		ApiId:                api.ID(),
+		IntegrationType:      pulumi.String("AWS_PROXY"),
+		IntegrationUri:       liveAlias.Arn,
+		PayloadFormatVersion: pulumi.String("2.0"),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = lambda.NewPermission(ctx, "apigwPermission", &lambda.PermissionArgs{
+		Action:    pulumi.String("lambda:InvokeFunction"),
+		Function:  myLambda.Name,
+		Qualifier: liveAlias.Name,
+		Principal: pulumi.String("apigateway.amazonaws.com"),
+		SourceArn: pulumi.Sprintf("%s/*/*", api.ExecutionArn),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "apiRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("$default"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "getRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "getCarRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /cars/{id}"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "listCarsRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /cars"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "patchCarRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("PATCH /cars/{id}"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "putCarRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("PUT /cars/{id}"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "deleteCarRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("DELETE /cars/{id}"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "statsByYearRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /stats/by-year"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "changesRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /changes"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "countRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /count"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "streamRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /stream"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "metricsRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /metrics"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	// Liveness probe for uptime monitors; it must stay without an
+	// authorizer so probes don't need credentials
+	_, err = apigatewayv2.NewRoute(ctx, "healthRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /health"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
 
-		_, err = apigatewayv2.NewRoute(ctx, "postRoute", &apigatewayv2.RouteArgs{
+	_, err = apigatewayv2.NewRoute(ctx, "healthDetailedRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("GET /health/detailed"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "postRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("POST /"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "exportRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("POST /export"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "batchRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("POST /batch"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = apigatewayv2.NewRoute(ctx, "reserveRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("POST /cars/reserve"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
+
+	if asyncWrites {
+		_, err = apigatewayv2.NewRoute(ctx, "writeStatusRoute", &apigatewayv2.RouteArgs{
 			ApiId:    api.ID(),
-			RouteKey: pulumi.String("POST /"),
+			RouteKey: pulumi.String("GET /writes/{id}"),
 			Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
 		})
 		if err != nil {
 			return err
 		}
+	}
 
-		stage, err := apigatewayv2.NewStage(ctx, "apiStage", &apigatewayv2.StageArgs{
-			ApiId:      api.ID(),
-			AutoDeploy: pulumi.Bool(true),
-			Name:       pulumi.String("$default"),
-		})
-		if err != nil {
-			return err
-		}
+	_, err = apigatewayv2.NewRoute(ctx, "patchRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("PATCH /"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
 
-		ctx.Export("apiUrl", pulumi.Sprintf("%s/%s", api.ApiEndpoint, stage.Name))
-		ctx.Export("tableName", table.Name)
+	_, err = apigatewayv2.NewRoute(ctx, "deleteRoute", &apigatewayv2.RouteArgs{
+		ApiId:    api.ID(),
+		RouteKey: pulumi.String("DELETE /"),
+		Target:   pulumi.Sprintf("integrations/%s", integration.ID()),
+	})
+	if err != nil {
+		return err
+	}
 
-		return nil
+	// Per-request access logs, one JSON line per request, kept as long
+	// as the Lambda's logs. HTTP APIs deliver them through API Gateway's
+	// service-linked role, so the group needs no resource policy.
+	accessLogs, err := cloudwatch.NewLogGroup(ctx, "apiAccessLogs", &cloudwatch.LogGroupArgs{
+		RetentionInDays: pulumi.Int(logRetentionDays),
 	})
+	if err != nil {
+		return err
+	}
+
+	stage, err := apigatewayv2.NewStage(ctx, "apiStage", &apigatewayv2.StageArgs{
+		ApiId:      api.ID(),
+		AutoDeploy: pulumi.Bool(true),
+		Name:       pulumi.String("$default"),
+		AccessLogSettings: &apigatewayv2.StageAccessLogSettingsArgs{
+			DestinationArn: accessLogs.Arn,
+			Format: pulumi.String(`{"requestId":"$context.requestId","httpMethod":"$context.httpMethod",` +
+				`"routeKey":"$context.routeKey","status":"$context.status",` +
+				`"responseLatency":"$context.responseLatency","ip":"$context.identity.sourceIp"}`),
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	// The $default stage is served at the API root; named stages get
+	// their own path segment
+	apiURL := pulumi.All(api.ApiEndpoint, stage.Name).ApplyT(func(args []interface{}) string {
+		return stageURL(args[0].(string), args[1].(string))
+	}).(pulumi.StringOutput)
+	ctx.Export("apiUrl", apiURL)
+	ctx.Export("tableName", table.Name)
+	ctx.Export("exportBucket", exportBucket.Bucket)
+	ctx.Export("replicaRegions", pulumi.ToStringArray(replicaRegions))
+	ctx.Export("canaryPercent", pulumi.Float64(canaryPercent))
+	ctx.Export("lambdaMemoryMb", pulumi.Int(lambdaMemoryMb))
+	ctx.Export("lambdaTimeoutSec", pulumi.Int(lambdaTimeoutSec))
+	ctx.Export("logRetentionDays", pulumi.Int(logRetentionDays))
+	ctx.Export("accessLogGroup", accessLogs.Name)
+
+	return nil
+}
+
+// stageURL is the base URL of the named stage of an API served at endpoint.
+func stageURL(endpoint, name string) string {
+	if name == "$default" {
+		return endpoint
+	}
+	return endpoint + "/" + name
 }
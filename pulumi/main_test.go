@@ -0,0 +1,298 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/pulumi/pulumi/sdk/v3/go/common/resource"
+	"github.com/pulumi/pulumi/sdk/v3/go/pulumi"
+)
+
+// publishedVersion is the version the mocks report for every function, as
+// Lambda would after publishing new code.
+const publishedVersion = "7"
+
+// mocks records the inputs of every resource createInfra declares, keyed by
+// type token and logical name.
+type mocks struct {
+	mu        sync.Mutex
+	resources map[string]resource.PropertyMap
+}
+
+func (m *mocks) NewResource(args pulumi.MockResourceArgs) (string, resource.PropertyMap, error) {
+	m.mu.Lock()
+	m.resources[args.TypeToken+"::"+args.Name] = args.Inputs
+	m.mu.Unlock()
+
+	state := args.Inputs.Copy()
+	state["arn"] = resource.NewStringProperty("arn:aws:mock:" + args.Name)
+	switch args.TypeToken {
+	case "aws:lambda/function:Function":
+		state["version"] = resource.NewStringProperty(publishedVersion)
+	case "aws:sqs/queue:Queue":
+		state["url"] = resource.NewStringProperty("https://sqs.mock/" + args.Name)
+	}
+	return args.Name + "_id", state, nil
+}
+
+func (m *mocks) Call(args pulumi.MockCallArgs) (resource.PropertyMap, error) {
+	return args.Args, nil
+}
+
+func (m *mocks) get(t *testing.T, typeToken, name string) resource.PropertyMap {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	inputs, ok := m.resources[typeToken+"::"+name]
+	if !ok {
+		t.Fatalf("no %s named %s", typeToken, name)
+	}
+	return inputs
+}
+
+func (m *mocks) has(typeToken, name string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.resources[typeToken+"::"+name]
+	return ok
+}
+
+// runInfra runs createInfra against mocks with the given stack config.
+func runInfra(t *testing.T, config map[string]string) (*mocks, error) {
+	t.Helper()
+	namespaced := map[string]string{}
+	for k, v := range config {
+		namespaced["my-rest-api:"+k] = v
+	}
+	raw, _ := json.Marshal(namespaced)
+	t.Setenv(pulumi.EnvConfig, string(raw))
+
+	m := &mocks{resources: map[string]resource.PropertyMap{}}
+	err := pulumi.RunErr(createInfra, pulumi.WithMocks("my-rest-api", "test", m))
+	return m, err
+}
+
+func TestRouteKeys(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   map[string]string
+		extra    []string
+		excluded []string
+	}{
+		{"sync writes", nil, nil, []string{"GET /writes/{id}"}},
+		{"async writes", map[string]string{"asyncWrites": "true"}, []string{"GET /writes/{id}"}, nil},
+	}
+	base := []string{
+		"$default",
+		"GET /", "GET /cars", "GET /cars/{id}",
+		"POST /", "POST /batch", "POST /export", "POST /cars/reserve",
+		"PUT /cars/{id}", "PATCH /cars/{id}", "DELETE /cars/{id}",
+		"PATCH /", "DELETE /",
+		"GET /stats/by-year", "GET /changes", "GET /count", "GET /stream",
+		"GET /metrics", "GET /health", "GET /health/detailed",
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := runInfra(t, tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var keys []string
+			m.mu.Lock()
+			for _, inputs := range m.resources {
+				if key, ok := inputs["routeKey"]; ok {
+					keys = append(keys, key.StringValue())
+				}
+			}
+			m.mu.Unlock()
+
+			want := append(slices.Clone(base), tt.extra...)
+			slices.Sort(keys)
+			slices.Sort(want)
+			if !slices.Equal(keys, want) {
+				t.Errorf("route keys = %v, want %v", keys, want)
+			}
+			for _, key := range tt.excluded {
+				if slices.Contains(keys, key) {
+					t.Errorf("unexpected route %s", key)
+				}
+			}
+		})
+	}
+}
+
+func TestLiveAliasCanary(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      map[string]string
+		wantVersion string
+		wantWeights map[string]float64
+		wantErr     bool
+	}{
+		{"follows the latest version", nil, publishedVersion, nil, false},
+		{"canary", map[string]string{"canaryPercent": "10", "stableVersion": "3"}, "3", map[string]float64{publishedVersion: 0.1}, false},
+		{"canary out of range", map[string]string{"canaryPercent": "100", "stableVersion": "3"}, "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := runInfra(t, tt.config)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			alias := m.get(t, "aws:lambda/alias:Alias", "liveAlias")
+			if got := alias["functionVersion"].StringValue(); got != tt.wantVersion {
+				t.Errorf("functionVersion = %q, want %q", got, tt.wantVersion)
+			}
+			weights := map[string]float64{}
+			if rc, ok := alias["routingConfig"]; ok && rc.IsObject() {
+				for k, v := range rc.ObjectValue()["additionalVersionWeights"].ObjectValue() {
+					weights[string(k)] = v.NumberValue()
+				}
+			}
+			if len(weights) != len(tt.wantWeights) {
+				t.Fatalf("weights = %v, want %v", weights, tt.wantWeights)
+			}
+			for v, w := range tt.wantWeights {
+				if weights[v] != w {
+					t.Errorf("weight of version %s = %v, want %v", v, weights[v], w)
+				}
+			}
+
+			integration := m.get(t, "aws:apigatewayv2/integration:Integration", "apiIntegration")
+			if got := integration["integrationUri"].StringValue(); got != "arn:aws:mock:liveAlias" {
+				t.Errorf("integration targets %q, want the live alias", got)
+			}
+		})
+	}
+}
+
+func TestWriteQueueWiring(t *testing.T) {
+	m, err := runInfra(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.has("aws:sqs/queue:Queue", "writes") {
+		t.Error("write queue created without asyncWrites")
+	}
+
+	m, err = runInfra(t, map[string]string{"asyncWrites": "true", "writeMaxReceives": "3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue := m.get(t, "aws:sqs/queue:Queue", "writes")
+	var redrive struct {
+		DeadLetterTargetArn string `json:"deadLetterTargetArn"`
+		MaxReceiveCount     int    `json:"maxReceiveCount"`
+	}
+	if err := json.Unmarshal([]byte(queue["redrivePolicy"].StringValue()), &redrive); err != nil {
+		t.Fatal(err)
+	}
+	if redrive.DeadLetterTargetArn != "arn:aws:mock:writeDeadLetters" || redrive.MaxReceiveCount != 3 {
+		t.Errorf("redrive policy = %+v", redrive)
+	}
+
+	mapping := m.get(t, "aws:lambda/eventSourceMapping:EventSourceMapping", "writeQueueMapping")
+	if got := mapping["eventSourceArn"].StringValue(); got != "arn:aws:mock:writes" {
+		t.Errorf("worker reads from %q, want the write queue", got)
+	}
+
+	env := m.get(t, "aws:lambda/function:Function", "myApiLambda")["environment"].ObjectValue()["variables"].ObjectValue()
+	if env["ASYNC_WRITES"].StringValue() != "true" || env["WRITE_QUEUE_URL"].StringValue() != "https://sqs.mock/writes" {
+		t.Errorf("api environment = %v", env)
+	}
+}
+
+func TestAPIURL(t *testing.T) {
+	tests := []struct {
+		stage string
+		want  string
+	}{
+		{"$default", "https://abc.execute-api.eu-west-1.amazonaws.com"},
+		{"prod", "https://abc.execute-api.eu-west-1.amazonaws.com/prod"},
+	}
+	for _, tt := range tests {
+		if got := stageURL("https://abc.execute-api.eu-west-1.amazonaws.com", tt.stage); got != tt.want {
+			t.Errorf("stageURL(%q) = %q, want %q", tt.stage, got, tt.want)
+		}
+	}
+
+	m, err := runInfra(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := m.get(t, "aws:apigatewayv2/stage:Stage", "apiStage")["name"].StringValue()
+	if url := stageURL("https://abc.execute-api.eu-west-1.amazonaws.com", name); strings.Contains(url, "$default") {
+		t.Errorf("apiUrl %q has a $default segment", url)
+	}
+}
+
+func TestStreamProcessorMatchesAPIFunction(t *testing.T) {
+	m, err := runInfra(t, map[string]string{"lambdaMemoryMb": "512", "lambdaTimeoutSec": "20", "logRetentionDays": "30"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"myApiLambda", "myApiStreamProcessor"} {
+		fn := m.get(t, "aws:lambda/function:Function", name)
+		if got := fn["memorySize"].NumberValue(); got != 512 {
+			t.Errorf("%s memorySize = %v, want 512", name, got)
+		}
+		if got := fn["timeout"].NumberValue(); got != 20 {
+			t.Errorf("%s timeout = %v, want 20", name, got)
+		}
+		if got := fn["tracingConfig"].ObjectValue()["mode"].StringValue(); got != "Active" {
+			t.Errorf("%s tracing mode = %q, want Active", name, got)
+		}
+	}
+	for _, name := range []string{"myApiLambdaLogs", "myApiStreamProcessorLogs"} {
+		if got := m.get(t, "aws:cloudwatch/logGroup:LogGroup", name)["retentionInDays"].NumberValue(); got != 30 {
+			t.Errorf("%s retention = %v, want 30", name, got)
+		}
+	}
+	xray := m.get(t, "aws:iam/rolePolicyAttachment:RolePolicyAttachment", "streamProcessorXRayWrite")
+	if got := xray["policyArn"].StringValue(); !strings.HasSuffix(got, "/AWSXRayDaemonWriteAccess") {
+		t.Errorf("stream processor X-Ray policy = %q", got)
+	}
+}
+
+func TestSecretsAccess(t *testing.T) {
+	m, err := runInfra(t, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.has("aws:iam/rolePolicy:RolePolicy", "lambdaSecretsAccess") {
+		t.Error("secrets policy created without secretsArn")
+	}
+
+	const arn = "arn:aws:secretsmanager:eu-west-1:123456789012:secret:cars-api"
+	m, err = runInfra(t, map[string]string{"secretsArn": arn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var policy struct {
+		Statement []struct {
+			Action   string
+			Resource string
+		}
+	}
+	raw := m.get(t, "aws:iam/rolePolicy:RolePolicy", "lambdaSecretsAccess")["policy"].StringValue()
+	if err := json.Unmarshal([]byte(raw), &policy); err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Statement) != 1 || policy.Statement[0].Action != "secretsmanager:GetSecretValue" || policy.Statement[0].Resource != arn {
+		t.Errorf("secrets policy = %s", raw)
+	}
+	env := m.get(t, "aws:lambda/function:Function", "myApiLambda")["environment"].ObjectValue()["variables"].ObjectValue()
+	if got := env["SECRETS_ARN"].StringValue(); got != arn {
+		t.Errorf("SECRETS_ARN = %q, want %q", got, arn)
+	}
+}